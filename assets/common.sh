@@ -71,13 +71,33 @@ start_docker() {
 
   local timeout=$3
 
-  for registry in $4; do
+  # dockerd resolves hostnames for CIDRs itself, but only matches other
+  # entries exactly, so wildcards and hostnames without a port are expanded
+  # to the registry hosts they match
+  local insecure_registries
+  read -r -a insecure_registries <<< "$4"
+  for registry in "${insecure_registries[@]}"; do
+    if [[ "$registry" != */* ]]; then
+      local host
+      for host in $6; do
+        if [ "$host" != "$registry" ] && host_matches "$registry" "$host"; then
+          server_args="${server_args} --insecure-registry ${host}"
+        fi
+      done
+
+      if [[ "$registry" == *'*'* ]]; then
+        continue
+      fi
+    fi
+
     server_args="${server_args} --insecure-registry ${registry}"
   done
 
-  if [ -n "$5" ]; then
-    server_args="${server_args} --registry-mirror $5"
-  fi
+  # dockerd tries the mirrors in order before falling back to Docker Hub
+  local mirror
+  for mirror in $5; do
+    server_args="${server_args} --registry-mirror ${mirror}"
+  done
 
   try_start() {
     dockerd --data-root /scratch/docker ${server_args} >$LOG_FILE 2>&1 &
@@ -114,6 +134,66 @@ stop_docker() {
   kill -TERM $pid
 }
 
+# Traces the commands run to stderr like set -x when source.debug is set,
+# redacting the secrets found in the payload and any added with
+# redact_secret.
+trace() {
+  local payload="$1"
+
+  if [ "$(jq -r '.source.debug // false' < "$payload")" != true ]; then
+    return 0
+  fi
+
+  secrets_file=$(mktemp /tmp/resource-secrets.XXXXXX)
+  jq -r '
+    .. | objects | to_entries[]
+    | select(.key | test("password|secret|token|key|auth|docker_config"; "i"))
+    | .value | strings | split("\n")[] | select(length > 3)
+  ' < "$payload" > "$secrets_file"
+
+  exec {trace_fd}> >(redact "$secrets_file" >&2)
+  BASH_XTRACEFD=$trace_fd
+  set -x
+}
+
+# Adds a secret obtained at runtime to the secrets redacted from the trace.
+redact_secret() {
+  local secret="$1"
+
+  if [ -n "${secrets_file:-}" ] && [ -n "${secret}" ]; then
+    echo "${secret}" >> "$secrets_file"
+  fi
+}
+
+redact() {
+  local secrets_file="$1"
+
+  local line secret
+  while IFS= read -r line; do
+    while IFS= read -r secret; do
+      line="${line//"$secret"/[REDACTED]}"
+    done < "$secrets_file"
+    printf '%s\n' "$line"
+  done
+}
+
+# Sets username and password to the credentials exchanged for the ones in
+# the payload, the same way check does. Tracing is suspended until the
+# password can be redacted.
+exchange_credentials() {
+  local payload="$1"
+
+  local -
+  set +x
+
+  local credentials
+  credentials=$(/opt/resource/credentials < "$payload")
+  username=$(echo "$credentials" | jq -r '.username')
+  password=$(echo "$credentials" | jq -r '.password')
+
+  redact_secret "$password"
+}
+
 log_in() {
   local username="$1"
   local password="$2"
@@ -129,6 +209,83 @@ log_in() {
   fi
 }
 
+# Uses the ECR credential helper for a registry, even if credentials for
+# other registries have been stored by docker login.
+use_ecr_login() {
+  local registry="$1"
+
+  mkdir -p ~/.docker
+  touch ~/.docker/config.json
+  echo "$(jq -s --arg registry "${registry}" 'add // {} | .credHelpers[$registry] = "ecr-login"' ~/.docker/config.json)" > ~/.docker/config.json
+}
+
+log_in_additional_registries() {
+  local additional_private_registries="$1"
+
+  # the base64 encoded entries decode to the passwords, which the trace would
+  # not redact
+  local -
+  set +x
+
+  # idea to use base64 to iterate over an array of json objects
+  # borrowed from https://www.starkandwayne.com/blog/bash-for-loop-over-json-array-using-jq/
+  local base64_line
+  for base64_line in $(echo "$additional_private_registries" | jq -r '.[] | @base64'); do
+    local additional_registry=$(echo $base64_line | base64 -d | jq -r '.registry')
+    local additional_username=$(echo $base64_line | base64 -d | jq -r '.username')
+    local additional_password=$(echo $base64_line | base64 -d | jq -r '.password')
+    log_in "$additional_username" "$additional_password" "$additional_registry"
+  done
+}
+
+# Writes an AWS profile assuming the given role, so that the ECR credential
+# helper fetches credentials for the role. The role is assumed with a web
+# identity token if one is given, and otherwise with the first credentials
+# found the way check finds them: the static keys in the environment, the
+# ECS task role, an EKS service account's web identity, or the EC2 instance
+# profile.
+assume_aws_role() {
+  local role_arn="$1"
+  local external_id="$2"
+  local web_identity_token_file="$3"
+
+  if [ -z "${role_arn}" ]; then
+    return 0
+  fi
+
+  mkdir -p ~/.aws
+  {
+    echo "[profile concourse]"
+    echo "role_arn = ${role_arn}"
+    echo "role_session_name = concourse-docker-image-resource"
+    if [ -n "${external_id}" ]; then
+      echo "external_id = ${external_id}"
+    fi
+    if [ -n "${web_identity_token_file}" ]; then
+      echo "web_identity_token_file = ${web_identity_token_file}"
+    elif [ -n "${AWS_ACCESS_KEY_ID:-}" ]; then
+      echo "credential_source = Environment"
+    elif [ -n "${AWS_CONTAINER_CREDENTIALS_RELATIVE_URI:-}" ] || [ -n "${AWS_CONTAINER_CREDENTIALS_FULL_URI:-}" ]; then
+      echo "credential_source = EcsContainer"
+    elif [ -n "${AWS_WEB_IDENTITY_TOKEN_FILE:-}" ] && [ -n "${AWS_ROLE_ARN:-}" ]; then
+      echo "source_profile = web-identity"
+      echo
+      echo "[profile web-identity]"
+      echo "role_arn = ${AWS_ROLE_ARN}"
+      echo "web_identity_token_file = ${AWS_WEB_IDENTITY_TOKEN_FILE}"
+    else
+      echo "credential_source = Ec2InstanceMetadata"
+    fi
+  } > ~/.aws/config
+
+  # a web identity in the environment would take precedence over the profile
+  if grep -q '^\[profile web-identity\]' ~/.aws/config; then
+    unset AWS_WEB_IDENTITY_TOKEN_FILE AWS_ROLE_ARN
+  fi
+
+  export AWS_PROFILE=concourse
+}
+
 private_registry() {
   local repository="${1}"
 
@@ -160,57 +317,291 @@ image_from_digest() {
   docker images --all --no-trunc --digests "$1" | awk "{if (\$3 == \"$2\") print \$4}"
 }
 
+# Writes the CA certs for dockerd, which trusts them on top of the system's
+# CAs for the host they are configured for.
 certs_to_file() {
   local raw_ca_certs="${1}"
+  shift
   local cert_count="$(echo $raw_ca_certs | jq -r '. | length')"
 
   for i in $(seq 0 $(expr "$cert_count" - 1));
   do
-    local cert_dir="/etc/docker/certs.d/$(echo $raw_ca_certs | jq -r .[$i].domain)"
-    mkdir -p "$cert_dir"
-    echo $raw_ca_certs | jq -r .[$i].cert >> "${cert_dir}/ca.crt"
+    local host
+    for host in $(cert_hosts "$(echo $raw_ca_certs | jq -r .[$i].domain)" "$@"); do
+      local cert_dir="/etc/docker/certs.d/${host}"
+      mkdir -p "$cert_dir"
+      echo $raw_ca_certs | jq -r .[$i].cert >> "${cert_dir}/ca.crt"
+    done
   done
 }
 
 set_client_certs() {
   local raw_client_certs="${1}"
+  shift
   local cert_count="$(echo $raw_client_certs | jq -r '. | length')"
 
   for i in $(seq 0 $(expr "$cert_count" - 1));
   do
-    local cert_dir="/etc/docker/certs.d/$(echo $raw_client_certs | jq -r .[$i].domain)"
-    [ -d "$cert_dir" ] || mkdir -p "$cert_dir"
-    echo $raw_client_certs | jq -r .[$i].cert >> "${cert_dir}/client.cert"
-    echo $raw_client_certs | jq -r .[$i].key >> "${cert_dir}/client.key"
+    local host
+    for host in $(cert_hosts "$(echo $raw_client_certs | jq -r .[$i].domain)" "$@"); do
+      local cert_dir="/etc/docker/certs.d/${host}"
+      [ -d "$cert_dir" ] || mkdir -p "$cert_dir"
+      echo $raw_client_certs | jq -r .[$i].cert >> "${cert_dir}/client.cert"
+      echo $raw_client_certs | jq -r .[$i].key >> "${cert_dir}/client.key"
+    done
   done
 }
 
-docker_pull() {
-  GREEN='\033[0;32m'
-  RED='\033[0;31m'
-  NC='\033[0m' # No Color
+# Prints the hosts whose directory under /etc/docker/certs.d should hold the
+# certs for a domain. dockerd only looks certs up by exact host:port, so the
+# certs for a domain without a port or with a wildcard are also written for
+# each of the given registry hosts the domain matches.
+cert_hosts() {
+  local domain="${1}"
+  shift
 
-  pull_attempt=1
-  max_attempts=3
-  while [ "$pull_attempt" -le "$max_attempts" ]; do
-    printf "Pulling ${GREEN}%s${NC}" "$1"
+  if [[ "$domain" != *'*'* ]]; then
+    echo "$domain"
+  fi
 
-    if [ "$pull_attempt" != "1" ]; then
-      printf " (attempt %s of %s)" "$pull_attempt" "$max_attempts"
+  local host
+  for host in "$@"; do
+    if [ "$host" != "$domain" ] && host_matches "$domain" "$host"; then
+      echo "$host"
     fi
+  done
+}
+
+# Succeeds if a configured domain applies to a host, as in check: a domain
+# without a port matches the host on any port, and a domain starting with "*."
+# matches any of its subdomains.
+host_matches() {
+  local domain="$1"
+  local host="$2"
+
+  local domain_name="$domain" domain_port=""
+  if [[ "$domain" == *:* ]]; then
+    domain_name="${domain%:*}"
+    domain_port="${domain##*:}"
+  fi
 
-    printf "...\n"
+  local hostname="$host" port=""
+  if [[ "$host" == *:* ]]; then
+    hostname="${host%:*}"
+    port="${host##*:}"
+  fi
+
+  if [ -n "$domain_port" ] && [ "$domain_port" != "$port" ]; then
+    return 1
+  fi
 
-    if docker pull "$1"; then
-      printf "\nSuccessfully pulled ${GREEN}%s${NC}.\n\n" "$1"
+  if [[ "$domain_name" == '*.'* ]]; then
+    local suffix="${domain_name#'*'}"
+    [[ "$hostname" == ?*"$suffix" ]]
+  else
+    [ "$domain_name" = "$hostname" ]
+  fi
+}
+
+# Prints the repository as served by each of the registry_mirrors_by_host
+# configured for its registry, in order: the mirror's host and path followed
+# by the repository's path within its registry.
+mirrored_repositories() {
+  local mirrors_by_host="${1}"
+  local repository="${2}"
+
+  local host path
+  if private_registry "${repository}"; then
+    host="$(extract_registry "${repository}")"
+    path="$(extract_repository "${repository}")"
+  else
+    host="docker.io"
+    path="${repository}"
+    if [[ "$path" != */* ]]; then
+      path="library/${path}"
+    fi
+  fi
+
+  echo "$mirrors_by_host" | jq -r --arg host "$host" --arg path "$path" '
+    def hostname: sub("^https?://"; "") | split("/")[0]
+      | if . == "index.docker.io" or . == "registry-1.docker.io" then "docker.io" else . end;
+    to_entries | sort_by(.key)[]
+    | select((.key | hostname) == ($host | hostname))
+    | .value[].url | sub("^https?://"; "") | rtrimstr("/") + "/" + $path'
+}
+
+# Pulls an image through the registry_mirrors_by_host configured for its
+# registry, trying each mirror once, and tags it with its own name once pulled
+# from a mirror so that builds use it. Falls back to pulling it from its
+# registry. Images referenced by digest cannot be tagged, so they are always
+# pulled from their registry.
+pull_through_mirrors() {
+  local mirrors_by_host="${1}"
+  local image="${2}"
+
+  if [[ "$image" != *@* ]]; then
+    local name="$image" tag="latest"
+    if [[ "${image##*/}" == *:* ]]; then
+      name="${image%:*}"
+      tag="${image##*:}"
+    fi
+
+    local mirrored_repository
+    for mirrored_repository in $(mirrored_repositories "$mirrors_by_host" "$name"); do
+      if retry_max_attempts=1 docker_pull "${mirrored_repository}:${tag}"; then
+        docker tag "${mirrored_repository}:${tag}" "$image"
+        return 0
+      fi
+    done
+  fi
+
+  docker_pull "$image"
+}
+
+# Prints the credentials of the registry_mirrors_by_host in the format of
+# additional_private_registries.
+mirror_credentials() {
+  local mirrors_by_host="${1}"
+
+  echo "$mirrors_by_host" | jq '[.[][] | select(.username) | {registry: (.url | sub("^https?://"; "") | split("/")[0]), username, password}]'
+}
+
+# Prints the host of each URL, such as the registry mirrors'.
+url_host() {
+  local url
+  for url in "$@"; do
+    url="${url#*://}"
+    echo "${url%%/*}"
+  done
+}
+
+# Reads source.retry and source.timeout, which apply to the pulls and pushes
+# of in and out the same way as to the requests made by check.
+configure_retries() {
+  local payload="$1"
+
+  retry_max_attempts=$(jq -r '.source.retry.max_attempts // 3' < "$payload")
+  retry_max_elapsed=$(duration_seconds "$(jq -r '.source.retry.max_elapsed // "5m"' < "$payload")")
+  retry_initial_interval=$(duration_seconds "$(jq -r '.source.retry.initial_interval // "1s"' < "$payload")")
+  attempt_timeout=$(duration_seconds "$(jq -r '.source.timeout // 0' < "$payload")")
+}
+
+# Converts a number of seconds or a duration such as "1m30s" to seconds.
+duration_seconds() {
+  echo "$1" | awk '
+    /^[0-9]+(\.[0-9]+)?$/ { print $0; exit }
+    {
+      s = $0
+      total = 0
+      while (s != "") {
+        if (!match(s, /^[0-9]+(\.[0-9]+)?/)) { exit 1 }
+        n = substr(s, 1, RLENGTH)
+        s = substr(s, RLENGTH + 1)
+
+        if (!match(s, /^(ms|h|m|s)/)) { exit 1 }
+        unit = substr(s, 1, RLENGTH)
+        s = substr(s, RLENGTH + 1)
+
+        total += n * (unit == "h" ? 3600 : unit == "m" ? 60 : unit == "s" ? 1 : 0.001)
+      }
+      print total
+    }
+  '
+}
+
+# Runs a command until it succeeds, as configured by source.retry: with an
+# exponential backoff from initial_interval, for at most max_attempts
+# attempts (unlimited if 0), and as long as the next attempt would start
+# within max_elapsed of the first. Failures which are not transient, such as
+# being denied, are not retried. Each attempt is limited to source.timeout if
+# configured.
+with_retries() {
+  local max_attempts="${retry_max_attempts:-3}"
+  local max_elapsed="${retry_max_elapsed:-300}"
+  local initial_interval="${retry_initial_interval:-1}"
+
+  local output
+  output=$(mktemp /tmp/attempt-output.XXXXXX)
+
+  local attempt=1
+  local interval="$initial_interval"
+  local start
+  start=$(date +%s)
+  while true; do
+    if run_attempt "$output" "$@"; then
+      rm -f "$output"
       return 0
     fi
 
-    echo
+    if ! retryable_failure "$output"; then
+      break
+    fi
+
+    if [ "$max_attempts" != 0 ] && [ "$attempt" -ge "$max_attempts" ]; then
+      break
+    fi
+
+    if awk -v elapsed="$(( $(date +%s) - start ))" -v interval="$interval" -v max="$max_elapsed" \
+      'BEGIN { exit !(elapsed + interval > max) }'; then
+      break
+    fi
+
+    attempt=$((attempt + 1))
+
+    printf "\nRetrying in %ss (attempt %s" "$interval" "$attempt"
+    if [ "$max_attempts" != 0 ]; then
+      printf " of %s" "$max_attempts"
+    fi
+    printf ")...\n"
+
+    sleep "$interval"
 
-    pull_attempt=$(expr "$pull_attempt" + 1)
+    interval=$(awk -v interval="$interval" -v initial="$initial_interval" \
+      'BEGIN { cap = initial > 16 ? initial : 16; interval *= 2; print (interval > cap ? cap : interval) }')
   done
 
+  rm -f "$output"
+  return 1
+}
+
+run_attempt() {
+  local output="$1"
+  shift
+
+  if [ "${attempt_timeout:-0}" != 0 ]; then
+    set -- timeout "$attempt_timeout" "$@"
+  fi
+
+  "$@" 2>&1 | tee "$output"
+  return "${PIPESTATUS[0]}"
+}
+
+# Reports whether the output of a failed pull or push suggests that trying
+# again may succeed, i.e. the request was not denied and the image exists.
+retryable_failure() {
+  local output="$1"
+
+  ! grep -q -i -E 'unauthorized|denied|not found|manifest unknown|name unknown|invalid reference format' "$output"
+}
+
+docker_pull() {
+  local platform="${2:-}"
+
+  GREEN='\033[0;32m'
+  RED='\033[0;31m'
+  NC='\033[0m' # No Color
+
+  printf "Pulling ${GREEN}%s${NC}...\n" "$1"
+
+  if with_retries docker pull ${platform:+--platform "$platform"} "$1"; then
+    printf "\nSuccessfully pulled ${GREEN}%s${NC}.\n\n" "$1"
+    return 0
+  fi
+
   printf "\n${RED}Failed to pull image %s.${NC}" "$1"
   return 1
 }
+
+docker_push() {
+  with_retries docker push "$1"
+}
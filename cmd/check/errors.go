@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/concourse/docker-image-resource/registry"
+	"github.com/docker/distribution/registry/api/errcode"
+)
+
+const ErrorFormatJSON = "json"
+
+// errorFormat is configured by source.error_format once the request has
+// been read.
+var errorFormat string
+
+// Kinds of errors reported by check.
+const (
+	ErrorKindUnauthorized = "unauthorized"
+	ErrorKindDenied       = "denied"
+	ErrorKindNotFound     = "not_found"
+	ErrorKindRateLimited  = "rate_limited"
+	ErrorKindTLS          = "tls"
+	ErrorKindNetwork      = "network"
+	ErrorKindUnknown      = "unknown"
+)
+
+// errorReport describes a failure, with a hint on how to fix it. It is
+// printed as-is when source.error_format is json.
+type errorReport struct {
+	Message string `json:"message"`
+	Kind    string `json:"kind"`
+	Code    string `json:"code,omitempty"`
+	Status  int    `json:"status,omitempty"`
+	Host    string `json:"host,omitempty"`
+	Hint    string `json:"hint,omitempty"`
+}
+
+// describe classifies an error returned while talking to the registry.
+func describe(err error) errorReport {
+	report := errorReport{
+		Message: err.Error(),
+		Kind:    ErrorKindUnknown,
+		Host:    errorHost(err),
+	}
+
+	code, status := errorCode(err)
+	report.Code = code
+	report.Status = status
+
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var certificateErr *tls.CertificateVerificationError
+	var recordHeaderErr tls.RecordHeaderError
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+
+	switch {
+	case code == registry.ErrorCodeUnauthorized || status == http.StatusUnauthorized:
+		report.Kind = ErrorKindUnauthorized
+		report.Hint = "check username/password for the registry; note that some registries also respond with 401 for repositories which do not exist"
+
+	case code == registry.ErrorCodeDenied || status == http.StatusForbidden:
+		report.Kind = ErrorKindDenied
+		report.Hint = "the credentials are valid but do not have access to the repository; check its permissions"
+
+	case code == registry.ErrorCodeTooManyRequests || status == http.StatusTooManyRequests:
+		report.Kind = ErrorKindRateLimited
+		report.Hint = "the registry is rate limiting requests; authenticate with username/password or configure a registry_mirror"
+
+	case code == registry.ErrorCodeManifestUnknown || code == registry.ErrorCodeNameUnknown || status == http.StatusNotFound:
+		report.Kind = ErrorKindNotFound
+		report.Hint = "does the image exist?"
+
+	case errors.As(err, &unknownAuthorityErr), errors.As(err, &certificateErr):
+		report.Kind = ErrorKindTLS
+		report.Hint = fmt.Sprintf("the certificate of %s is signed by an unknown authority; add ca_certs for host %s, or add it to insecure_registries", report.Host, report.Host)
+
+	case errors.As(err, &hostnameErr):
+		report.Kind = ErrorKindTLS
+		report.Hint = fmt.Sprintf("the certificate of %s is not valid for that name; check the registry host in repository", report.Host)
+
+	case errors.As(err, &recordHeaderErr):
+		report.Kind = ErrorKindTLS
+		report.Hint = fmt.Sprintf("%s does not appear to serve https; add it to insecure_registries to allow http", report.Host)
+
+	case errors.As(err, &dnsErr), errors.As(err, &opErr):
+		report.Kind = ErrorKindNetwork
+		report.Hint = fmt.Sprintf("check that %s is reachable from the worker, including any proxy settings", report.Host)
+	}
+
+	return report
+}
+
+// errorCode returns the registry error code and HTTP status of an error, if
+// known. Errors from the token service are reported by the distribution
+// client as errcode errors rather than status errors.
+func errorCode(err error) (string, int) {
+	var statusErr *registry.StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Code(), statusErr.StatusCode
+	}
+
+	var codeErr errcode.Error
+	if errors.As(err, &codeErr) {
+		return codeErr.ErrorCode().String(), codeErr.ErrorCode().Descriptor().HTTPStatusCode
+	}
+
+	var codeErrs errcode.Errors
+	if errors.As(err, &codeErrs) && len(codeErrs) > 0 {
+		return errorCode(codeErrs[0])
+	}
+
+	return "", 0
+}
+
+func errorHost(err error) string {
+	var pingErr *registry.PingError
+	if errors.As(err, &pingErr) {
+		return pingErr.Host
+	}
+
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		if u, parseErr := url.Parse(urlErr.URL); parseErr == nil {
+			return u.Host
+		}
+	}
+
+	var statusErr *registry.StatusError
+	if errors.As(err, &statusErr) {
+		if u, parseErr := url.Parse(statusErr.URL); parseErr == nil {
+			return u.Host
+		}
+	}
+
+	return ""
+}
+
+func fatalIf(doing string, err error) {
+	if err != nil {
+		report := describe(err)
+		report.Message = doing + ": " + err.Error()
+		exit(report)
+	}
+}
+
+func fatal(message string) {
+	exit(errorReport{Message: message, Kind: ErrorKindUnknown})
+}
+
+func exit(report errorReport) {
+	if errorFormat == ErrorFormatJSON {
+		json.NewEncoder(os.Stderr).Encode(report)
+	} else {
+		println(report.Message)
+		if report.Hint != "" {
+			println("hint: " + report.Hint)
+		}
+	}
+
+	os.Exit(1)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/concourse/docker-image-resource/registry"
+	"github.com/docker/distribution/registry/api/errcode"
+)
+
+var _ = Describe("describe", func() {
+	statusError := func(statusCode int, codes ...string) error {
+		err := &registry.StatusError{
+			Method:     http.MethodHead,
+			URL:        "https://registry.example.com/v2/some/image/manifests/latest",
+			StatusCode: statusCode,
+			Status:     http.StatusText(statusCode),
+		}
+		for _, code := range codes {
+			err.Errors = append(err.Errors, registry.ErrorDetail{Code: code})
+		}
+		return fmt.Errorf("failed to fetch manifest: %w", err)
+	}
+
+	DescribeTable("classifies registry responses",
+		func(err error, kind string, code string) {
+			report := describe(err)
+			Expect(report.Kind).To(Equal(kind))
+			Expect(report.Code).To(Equal(code))
+			Expect(report.Host).To(Equal("registry.example.com"))
+			Expect(report.Hint).ToNot(BeEmpty())
+		},
+		Entry("unauthorized", statusError(http.StatusUnauthorized, registry.ErrorCodeUnauthorized), ErrorKindUnauthorized, registry.ErrorCodeUnauthorized),
+		Entry("unauthorized without a body", statusError(http.StatusUnauthorized), ErrorKindUnauthorized, ""),
+		Entry("denied", statusError(http.StatusForbidden, registry.ErrorCodeDenied), ErrorKindDenied, registry.ErrorCodeDenied),
+		Entry("unknown manifest", statusError(http.StatusNotFound, registry.ErrorCodeManifestUnknown), ErrorKindNotFound, registry.ErrorCodeManifestUnknown),
+		Entry("rate limited", statusError(http.StatusTooManyRequests, registry.ErrorCodeTooManyRequests), ErrorKindRateLimited, registry.ErrorCodeTooManyRequests),
+	)
+
+	It("classifies errors from the token service", func() {
+		err := &url.Error{
+			Op:  "Head",
+			URL: "https://registry.example.com/v2/some/image/manifests/latest",
+			Err: errcode.ErrorCodeUnauthorized.WithMessage("incorrect username or password"),
+		}
+
+		report := describe(err)
+		Expect(report.Kind).To(Equal(ErrorKindUnauthorized))
+		Expect(report.Code).To(Equal(registry.ErrorCodeUnauthorized))
+	})
+
+	It("suggests ca_certs for certificates signed by an unknown authority", func() {
+		err := &registry.PingError{
+			Host: "registry.example.com:443",
+			Err:  x509.UnknownAuthorityError{},
+		}
+
+		report := describe(err)
+		Expect(report.Kind).To(Equal(ErrorKindTLS))
+		Expect(report.Hint).To(ContainSubstring("add ca_certs for host registry.example.com:443"))
+	})
+
+	It("reports unreachable registries", func() {
+		err := &registry.PingError{
+			Host: "registry.example.com",
+			Err:  &net.DNSError{Err: "no such host", Name: "registry.example.com"},
+		}
+
+		report := describe(err)
+		Expect(report.Kind).To(Equal(ErrorKindNetwork))
+		Expect(report.Hint).To(ContainSubstring("registry.example.com"))
+	})
+
+	It("falls back to an unknown error", func() {
+		report := describe(fmt.Errorf("something broke"))
+		Expect(report.Kind).To(Equal(ErrorKindUnknown))
+		Expect(report.Hint).To(BeEmpty())
+	})
+})
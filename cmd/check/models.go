@@ -1,24 +1,27 @@
 package main
 
-import "encoding/json"
+import (
+	"encoding/json"
+
+	"github.com/concourse/docker-image-resource/registry"
+)
 
 type Source struct {
-	Repository         string          `json:"repository"`
-	Tag                Tag             `json:"tag"`
-	Username           string          `json:"username"`
-	Password           string          `json:"password"`
-	InsecureRegistries []string        `json:"insecure_registries"`
-	RegistryMirror     string          `json:"registry_mirror"`
-	DomainCerts        []DomainCert    `json:"ca_certs"`
-	ClientCerts        []ClientCertKey `json:"client_certs"`
-
-	AWSAccessKeyID     string `json:"aws_access_key_id"`
-	AWSSecretAccessKey string `json:"aws_secret_access_key"`
-	AWSSessionToken    string `json:"aws_session_token"`
+	registry.Config
+
+	Tag                Tag                `json:"tag"`
+	TagRegex           string             `json:"tag_regex"`
+	TagOrdering        string             `json:"tag_ordering"`
+	SemverConstraint   string             `json:"semver_constraint"`
+	Variant            string             `json:"variant"`
+	IncludePrereleases bool               `json:"include_prereleases"`
+	Platform           *registry.Platform `json:"platform"`
+	ErrorFormat        string             `json:"error_format"`
 }
 
 type Version struct {
 	Digest string `json:"digest"`
+	Tag    string `json:"tag,omitempty"`
 }
 
 type CheckRequest struct {
@@ -28,17 +31,6 @@ type CheckRequest struct {
 
 type CheckResponse []Version
 
-type DomainCert struct {
-	Domain string `json:"domain"`
-	Cert   string `json:"cert"`
-}
-
-type ClientCertKey struct {
-	Domain string `json:"domain"`
-	Cert   string `json:"cert"`
-	Key    string `json:"key"`
-}
-
 // Tag refers to a tag for an image in the registry.
 type Tag string
 
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/concourse/docker-image-resource/registry"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// resolveDigest returns the digest of the manifest referenced by a tag or a
+// digest. When a platform is configured and the manifest is an index (or
+// manifest list), the digest of the matching platform's manifest is returned
+// instead.
+func resolveDigest(client *registry.Client, source Source, ref string, tag string) (string, bool) {
+	if source.Platform == nil {
+		digest, err := client.ResolveDigest(ref)
+		if !found(err, source.Repository, tag) {
+			return "", false
+		}
+
+		return digest, true
+	}
+
+	// a HEAD request is enough unless the manifest is an index, whose body is
+	// needed to select the platform's manifest
+	head, err := client.HeadManifest(ref)
+	if !found(err, source.Repository, tag) {
+		return "", false
+	}
+
+	if head.Digest != "" && (head.MediaType == registry.MediaTypeDockerManifest || head.MediaType == ocispec.MediaTypeImageManifest) {
+		return string(head.Digest), true
+	}
+
+	manifest, err := client.GetManifest(ref)
+	if !found(err, source.Repository, tag) {
+		return "", false
+	}
+
+	if !manifest.IsIndex() {
+		return string(manifest.Digest), true
+	}
+
+	var index ocispec.Index
+	err = json.Unmarshal(manifest.Body, &index)
+	fatalIf("failed to unmarshal image index", err)
+
+	platformManifest, found := source.Platform.SelectManifest(index.Manifests)
+	if !found {
+		fatal(fmt.Sprintf("no manifest for platform %s found in image '%s:%s'", source.Platform, source.Repository, tag))
+	}
+
+	fmt.Fprintf(os.Stderr, "selected %s manifest %s from index %s\n", source.Platform, platformManifest.Digest, manifest.Digest)
+
+	return string(platformManifest.Digest), true
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/concourse/docker-image-resource/registry"
+)
+
+const (
+	TagOrderingSemver  = "semver"
+	TagOrderingNumeric = "numeric"
+	TagOrderingLexical = "lexical"
+	TagOrderingCreated = "created"
+)
+
+// numericTag matches the tags ordered by the numeric tag ordering: plain
+// decimal numbers, rather than everything strconv.ParseFloat accepts (such as
+// NaN, Inf, 1e3 or 0x10).
+var numericTag = regexp.MustCompile(`^\d+(\.\d+)?$`)
+
+// checkTags tracks the tags matching source.tag_regex and/or
+// source.semver_constraint, emitting the cursor (if it still exists and still
+// matches) followed by every newer tag.
+func checkTags(client *registry.Client, request CheckRequest) CheckResponse {
+	tags, err := client.ListTags()
+	fatalIf(fmt.Sprintf("failed to list tags for '%s'", request.Source.Repository), err)
+
+	if request.Source.TagRegex != "" {
+		tags, err = filterTags(tags, request.Source.TagRegex)
+		fatalIf("failed to compile tag regex", err)
+	}
+
+	ordering := request.Source.TagOrdering
+	if ordering == "" {
+		ordering = TagOrderingSemver
+	}
+
+	if ordering == TagOrderingSemver {
+		tags, err = semverTags(tags, request.Source.SemverConstraint, request.Source.Variant, request.Source.IncludePrereleases)
+		fatalIf("failed to parse semver constraint", err)
+	} else if request.Source.SemverConstraint != "" {
+		fatal(fmt.Sprintf("semver_constraint requires tag_ordering '%s'", TagOrderingSemver))
+	}
+
+	tags, err = sortTags(tags, ordering, request.Source.Variant)
+	fatalIf("failed to sort tags", err)
+
+	if len(tags) == 0 {
+		return CheckResponse{}
+	}
+
+	// only tags from the cursor onwards can be emitted, so avoid resolving
+	// the digests of older tags unless they have to be ordered by creation
+	start := len(tags) - 1
+	if ordering == TagOrderingCreated {
+		start = 0
+	} else if i := slices.Index(tags, request.Version.Tag); request.Version.Tag != "" && i != -1 {
+		start = i
+	}
+
+	var candidates []Version
+	for _, tag := range tags[start:] {
+		tagDigest, found := resolveDigest(client, request.Source, tag, tag)
+		if found {
+			candidates = append(candidates, Version{Digest: tagDigest, Tag: tag})
+		}
+	}
+
+	if ordering == TagOrderingCreated {
+		candidates = sortByCreated(candidates, createdTimes(client, request.Source, candidates))
+	}
+
+	return versionsSince(request.Version, candidates)
+}
+
+// filterTags returns the tags matching the given pattern. The pattern must
+// match the whole tag.
+func filterTags(tags []string, pattern string) ([]string, error) {
+	rTag, err := regexp.Compile("^(?:" + pattern + ")$")
+	if err != nil {
+		return nil, err
+	}
+
+	var matched []string
+	for _, tag := range tags {
+		if rTag.MatchString(tag) {
+			matched = append(matched, tag)
+		}
+	}
+
+	return matched, nil
+}
+
+// semverTags returns the tags which are semantic versions satisfying the
+// given constraint. Tags must end in "-<variant>" when a variant is given, and
+// pre-releases are only kept when includePrereleases is set.
+func semverTags(tags []string, constraint string, variant string, includePrereleases bool) ([]string, error) {
+	var constraints *semver.Constraints
+	if constraint != "" {
+		var err error
+		constraints, err = semver.NewConstraint(constraint)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var matched []string
+	for _, tag := range tags {
+		version, ok := tagVersion(tag, variant)
+		if !ok {
+			continue
+		}
+
+		if version.Prerelease() != "" {
+			if !includePrereleases {
+				continue
+			}
+
+			// constraints never match pre-releases unless they mention one
+			// themselves, so compare the release it leads up to instead
+			release, err := version.SetPrerelease("")
+			if err != nil {
+				continue
+			}
+			version = &release
+		}
+
+		if constraints != nil && !constraints.Check(version) {
+			continue
+		}
+
+		matched = append(matched, tag)
+	}
+
+	return matched, nil
+}
+
+// tagVersion parses the semantic version of a tag, after stripping the
+// "-<variant>" suffix if a variant is given.
+func tagVersion(tag string, variant string) (*semver.Version, bool) {
+	if variant != "" {
+		suffix := "-" + variant
+		if !strings.HasSuffix(tag, suffix) {
+			return nil, false
+		}
+		tag = strings.TrimSuffix(tag, suffix)
+	}
+
+	version, err := semver.NewVersion(tag)
+	if err != nil {
+		return nil, false
+	}
+
+	return version, true
+}
+
+// sortTags orders the tags from oldest to newest according to the given
+// ordering. Tags which cannot be interpreted by the ordering are dropped.
+func sortTags(tags []string, ordering string, variant string) ([]string, error) {
+	switch ordering {
+	case "", TagOrderingSemver:
+		versions := map[string]*semver.Version{}
+		var sorted []string
+		for _, tag := range tags {
+			version, ok := tagVersion(tag, variant)
+			if !ok {
+				continue
+			}
+			versions[tag] = version
+			sorted = append(sorted, tag)
+		}
+
+		sort.SliceStable(sorted, func(i, j int) bool {
+			return versions[sorted[i]].LessThan(versions[sorted[j]])
+		})
+
+		return sorted, nil
+
+	case TagOrderingNumeric:
+		numbers := map[string]float64{}
+		var sorted []string
+		for _, tag := range tags {
+			if !numericTag.MatchString(tag) {
+				continue
+			}
+
+			number, err := strconv.ParseFloat(tag, 64)
+			if err != nil {
+				continue
+			}
+			numbers[tag] = number
+			sorted = append(sorted, tag)
+		}
+
+		sort.SliceStable(sorted, func(i, j int) bool {
+			return numbers[sorted[i]] < numbers[sorted[j]]
+		})
+
+		return sorted, nil
+
+	case TagOrderingLexical:
+		sorted := append([]string{}, tags...)
+		sort.Strings(sorted)
+		return sorted, nil
+
+	case TagOrderingCreated:
+		// ordered by the creation time of each tag's image once resolved
+		return tags, nil
+	}
+
+	return nil, fmt.Errorf("unknown tag ordering '%s' (must be one of %s, %s, %s or %s)", ordering, TagOrderingSemver, TagOrderingNumeric, TagOrderingLexical, TagOrderingCreated)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Tags", func() {
+	Describe("filterTags", func() {
+		It("only keeps tags matching the whole pattern", func() {
+			tags, err := filterTags([]string{"1.2.3", "1.2.3-rc1", "v1.2.4", "latest"}, `v?1\.\d+\.\d+`)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(tags).To(Equal([]string{"1.2.3", "v1.2.4"}))
+		})
+
+		It("errors on an invalid pattern", func() {
+			_, err := filterTags([]string{"1.2.3"}, `(`)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("semverTags", func() {
+		tags := []string{"1.3.0", "1.4.0", "1.4.1-rc.1", "1.9.2", "2.0.0", "1.5.0-alpine", "1.6.0-rc.1-alpine", "latest"}
+
+		It("keeps the releases satisfying the constraint", func() {
+			matched, err := semverTags(tags, ">=1.4 <2", "", false)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(matched).To(Equal([]string{"1.4.0", "1.9.2"}))
+		})
+
+		It("keeps every release when there is no constraint", func() {
+			matched, err := semverTags(tags, "", "", false)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(matched).To(Equal([]string{"1.3.0", "1.4.0", "1.9.2", "2.0.0"}))
+		})
+
+		It("includes pre-releases when asked to", func() {
+			matched, err := semverTags(tags, ">=1.4 <2", "", true)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(matched).To(Equal([]string{"1.4.0", "1.4.1-rc.1", "1.9.2", "1.5.0-alpine", "1.6.0-rc.1-alpine"}))
+		})
+
+		It("only keeps tags of the given variant", func() {
+			matched, err := semverTags(tags, ">=1.4 <2", "alpine", false)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(matched).To(Equal([]string{"1.5.0-alpine"}))
+
+			matched, err = semverTags(tags, ">=1.4 <2", "alpine", true)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(matched).To(Equal([]string{"1.5.0-alpine", "1.6.0-rc.1-alpine"}))
+		})
+
+		It("errors on an invalid constraint", func() {
+			_, err := semverTags(tags, ">>1", "", false)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("sortTags", func() {
+		It("orders by semantic version by default, dropping invalid versions", func() {
+			tags, err := sortTags([]string{"1.10.0", "1.2.0", "latest", "1.9.1"}, "", "")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(tags).To(Equal([]string{"1.2.0", "1.9.1", "1.10.0"}))
+		})
+
+		It("orders semantic versions of a variant", func() {
+			tags, err := sortTags([]string{"1.10.0-alpine", "1.2.0-alpine", "1.3.0"}, TagOrderingSemver, "alpine")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(tags).To(Equal([]string{"1.2.0-alpine", "1.10.0-alpine"}))
+		})
+
+		It("orders numerically", func() {
+			tags, err := sortTags([]string{"10", "9", "100", "abc"}, TagOrderingNumeric, "")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(tags).To(Equal([]string{"9", "10", "100"}))
+		})
+
+		It("orders only plain decimal numbers numerically", func() {
+			tags, err := sortTags([]string{"1.5", "nan", "NaN", "Inf", "-1", "+2", "1e3", "0x10", "1_000", "2"}, TagOrderingNumeric, "")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(tags).To(Equal([]string{"1.5", "2"}))
+		})
+
+		It("orders lexically", func() {
+			tags, err := sortTags([]string{"b", "a10", "a9"}, TagOrderingLexical, "")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(tags).To(Equal([]string{"a10", "a9", "b"}))
+		})
+
+		It("leaves tags ordered by creation time as they are", func() {
+			tags, err := sortTags([]string{"b", "a"}, TagOrderingCreated, "")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(tags).To(Equal([]string{"b", "a"}))
+		})
+
+		It("errors on an unknown ordering", func() {
+			_, err := sortTags([]string{"1"}, "bogus", "")
+			Expect(err).To(MatchError(ContainSubstring("unknown tag ordering 'bogus'")))
+		})
+	})
+})
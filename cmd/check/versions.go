@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/concourse/docker-image-resource/registry"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// versionsSince returns the versions to emit for a check, given every
+// candidate version ordered from oldest to newest.
+//
+// If the cursor is among the candidates, it is returned along with every
+// version after it. Otherwise only the newest version is returned. Versions
+// with a tag are matched to the cursor by tag, so a tag that has been pushed
+// again since the cursor is still considered the cursor.
+func versionsSince(cursor Version, candidates []Version) CheckResponse {
+	response := CheckResponse{}
+	if len(candidates) == 0 {
+		return response
+	}
+
+	for i, candidate := range candidates {
+		if isCursor(cursor, candidate) {
+			return append(response, candidates[i:]...)
+		}
+	}
+
+	return append(response, candidates[len(candidates)-1])
+}
+
+func isCursor(cursor Version, candidate Version) bool {
+	if cursor.Digest == "" {
+		return false
+	}
+
+	if cursor.Tag != "" {
+		return cursor.Tag == candidate.Tag
+	}
+
+	return cursor.Digest == candidate.Digest
+}
+
+// sortByCreated orders versions from oldest to newest by the given creation
+// times, keyed by digest. Versions with the same creation time keep their
+// relative order.
+func sortByCreated(versions []Version, created map[string]time.Time) []Version {
+	sorted := append([]Version{}, versions...)
+
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return created[sorted[i].Digest].Before(created[sorted[j].Digest])
+	})
+
+	return sorted
+}
+
+// createdTimes fetches the creation time from the image config of each
+// version.
+func createdTimes(client *registry.Client, source Source, versions []Version) map[string]time.Time {
+	created := map[string]time.Time{}
+	for _, version := range versions {
+		created[version.Digest] = fetchCreated(client, source, version.Digest)
+	}
+
+	return created
+}
+
+func fetchCreated(client *registry.Client, source Source, manifestDigest string) time.Time {
+	manifest, err := client.GetManifest(manifestDigest)
+	fatalIf(fmt.Sprintf("failed to fetch manifest '%s@%s'", source.Repository, manifestDigest), err)
+
+	if manifest.IsIndex() {
+		var index ocispec.Index
+		err := json.Unmarshal(manifest.Body, &index)
+		fatalIf("failed to unmarshal image index", err)
+
+		platform := registry.Platform{OS: "linux", Architecture: "amd64"}
+		if source.Platform != nil {
+			platform = *source.Platform
+		}
+
+		platformManifest, found := platform.SelectManifest(index.Manifests)
+		if !found {
+			fatal(fmt.Sprintf("no manifest for platform %s found in image '%s@%s'", platform, source.Repository, manifestDigest))
+		}
+
+		return fetchCreated(client, source, string(platformManifest.Digest))
+	}
+
+	var imageManifest ocispec.Manifest
+	err = json.Unmarshal(manifest.Body, &imageManifest)
+	fatalIf("failed to unmarshal manifest", err)
+
+	configBlob, err := client.GetBlob(imageManifest.Config.Digest)
+	fatalIf(fmt.Sprintf("failed to fetch config for image '%s@%s'", source.Repository, manifestDigest), err)
+
+	defer configBlob.Close()
+
+	var config ocispec.Image
+	err = json.NewDecoder(configBlob).Decode(&config)
+	fatalIf("failed to unmarshal image config", err)
+
+	if config.Created == nil {
+		return time.Time{}
+	}
+
+	return *config.Created
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Versions", func() {
+	Describe("versionsSince", func() {
+		Context("with digest-only versions", func() {
+			candidates := []Version{
+				{Digest: "sha256:a"},
+				{Digest: "sha256:b"},
+				{Digest: "sha256:c"},
+			}
+
+			It("returns nothing when there are no candidates", func() {
+				Expect(versionsSince(Version{Digest: "sha256:a"}, nil)).To(BeEmpty())
+			})
+
+			It("returns the newest version when there is no cursor", func() {
+				Expect(versionsSince(Version{}, candidates)).To(Equal(CheckResponse{
+					{Digest: "sha256:c"},
+				}))
+			})
+
+			It("returns the cursor and every newer version", func() {
+				Expect(versionsSince(Version{Digest: "sha256:b"}, candidates)).To(Equal(CheckResponse{
+					{Digest: "sha256:b"},
+					{Digest: "sha256:c"},
+				}))
+			})
+
+			It("returns only the cursor when it is the newest version", func() {
+				Expect(versionsSince(Version{Digest: "sha256:c"}, candidates)).To(Equal(CheckResponse{
+					{Digest: "sha256:c"},
+				}))
+			})
+
+			It("returns the newest version when the cursor is gone", func() {
+				Expect(versionsSince(Version{Digest: "sha256:z"}, candidates)).To(Equal(CheckResponse{
+					{Digest: "sha256:c"},
+				}))
+			})
+		})
+
+		Context("with tagged versions", func() {
+			candidates := []Version{
+				{Digest: "sha256:a", Tag: "1.0.0"},
+				{Digest: "sha256:b", Tag: "1.1.0"},
+				{Digest: "sha256:c", Tag: "1.2.0"},
+			}
+
+			It("returns the cursor and every newer version", func() {
+				Expect(versionsSince(Version{Digest: "sha256:a", Tag: "1.0.0"}, candidates)).To(Equal(CheckResponse(candidates)))
+			})
+
+			It("matches the cursor by tag when the tag has been pushed again", func() {
+				Expect(versionsSince(Version{Digest: "sha256:old", Tag: "1.1.0"}, candidates)).To(Equal(CheckResponse{
+					{Digest: "sha256:b", Tag: "1.1.0"},
+					{Digest: "sha256:c", Tag: "1.2.0"},
+				}))
+			})
+
+			It("does not match a cursor with the same digest but another tag", func() {
+				Expect(versionsSince(Version{Digest: "sha256:a", Tag: "1.0"}, candidates)).To(Equal(CheckResponse{
+					{Digest: "sha256:c", Tag: "1.2.0"},
+				}))
+			})
+		})
+	})
+
+	Describe("sortByCreated", func() {
+		now := time.Now()
+
+		It("orders versions from oldest to newest", func() {
+			sorted := sortByCreated([]Version{
+				{Digest: "sha256:a"},
+				{Digest: "sha256:b"},
+				{Digest: "sha256:c"},
+			}, map[string]time.Time{
+				"sha256:a": now,
+				"sha256:b": now.Add(-time.Hour),
+				"sha256:c": now.Add(time.Hour),
+			})
+
+			Expect(sorted).To(Equal([]Version{
+				{Digest: "sha256:b"},
+				{Digest: "sha256:a"},
+				{Digest: "sha256:c"},
+			}))
+		})
+
+		It("keeps the order of versions created at the same time", func() {
+			sorted := sortByCreated([]Version{
+				{Digest: "sha256:b"},
+				{Digest: "sha256:a"},
+			}, map[string]time.Time{
+				"sha256:a": now,
+				"sha256:b": now,
+			})
+
+			Expect(sorted).To(Equal([]Version{
+				{Digest: "sha256:b"},
+				{Digest: "sha256:a"},
+			}))
+		})
+
+		It("treats a rolled back tag as older than the cursor", func() {
+			cursor := Version{Digest: "sha256:newer"}
+
+			sorted := sortByCreated([]Version{
+				cursor,
+				{Digest: "sha256:older"},
+			}, map[string]time.Time{
+				"sha256:newer": now,
+				"sha256:older": now.Add(-time.Hour),
+			})
+
+			Expect(versionsSince(cursor, sorted)).To(Equal(CheckResponse{cursor}))
+		})
+	})
+})
@@ -0,0 +1,44 @@
+// Command credentials prints the username and password with which
+// assets/in and assets/out log in to the registry of source.repository,
+// exchanging ECR, GCP or Azure credentials for them the same way check does.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/concourse/docker-image-resource/registry"
+)
+
+type Request struct {
+	Source registry.Config `json:"source"`
+}
+
+type Credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+func main() {
+	var request Request
+	err := json.NewDecoder(os.Stdin).Decode(&request)
+	if err != nil {
+		fatal("failed to read request: " + err.Error())
+	}
+
+	username, password, err := registry.LoginCredentials(request.Source)
+	if err != nil {
+		fatal("failed to get registry credentials: " + err.Error())
+	}
+
+	json.NewEncoder(os.Stdout).Encode(Credentials{
+		Username: username,
+		Password: password,
+	})
+}
+
+func fatal(message string) {
+	fmt.Fprintln(os.Stderr, message)
+	os.Exit(1)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+
+	"github.com/concourse/docker-image-resource/registry"
+)
+
+var rImageInstruction = regexp.MustCompile(`(?i)^\s*(FROM|ARG)\s`)
+
+// ecrImages returns the images hosted by ECR registries which FROM and ARG
+// instructions of a Dockerfile refer to, so that they can be pulled with ECR
+// credentials before building.
+func ecrImages(config registry.Config, dockerfile io.Reader) ([]string, error) {
+	var images []string
+
+	scanner := bufio.NewScanner(dockerfile)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !rImageInstruction.MatchString(line) {
+			continue
+		}
+
+		words := strings.FieldsFunc(line, func(r rune) bool {
+			return unicode.IsSpace(r) || r == '=' || r == '"' || r == '\''
+		})
+
+		for _, word := range words {
+			host, _, found := strings.Cut(word, "/")
+			if found && config.IsECR(host) && !slices.Contains(images, word) {
+				images = append(images, word)
+			}
+		}
+	}
+
+	return images, scanner.Err()
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/concourse/docker-image-resource/registry"
+)
+
+var _ = Describe("ecrImages", func() {
+	const dockerfile = `ARG BASE=123456789012.dkr.ecr.us-east-1.amazonaws.com/base:1
+FROM --platform=linux/amd64 123456789012.dkr.ecr-fips.us-gov-west-1.amazonaws.com/builder AS builder
+FROM 123456789012.dkr-ecr.eu-west-1.on.aws/dual-stack:latest
+from 123456789012.dkr.ecr.cn-north-1.amazonaws.com.cn/china
+FROM registry.corp.local/app/base
+FROM public.ecr.aws/docker/library/alpine
+FROM ${BASE}
+COPY --from=builder 123456789012.dkr.ecr.us-east-1.amazonaws.com/not/an/image /
+FROM 123456789012.dkr.ecr.us-east-1.amazonaws.com/base:1
+`
+
+	It("finds the images hosted by ECR, including FIPS and dual-stack endpoints", func() {
+		images, err := ecrImages(registry.Config{}, strings.NewReader(dockerfile))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(images).To(Equal([]string{
+			"123456789012.dkr.ecr.us-east-1.amazonaws.com/base:1",
+			"123456789012.dkr.ecr-fips.us-gov-west-1.amazonaws.com/builder",
+			"123456789012.dkr-ecr.eu-west-1.on.aws/dual-stack:latest",
+			"123456789012.dkr.ecr.cn-north-1.amazonaws.com.cn/china",
+		}))
+	})
+
+	It("includes images from the repository's registry when source.ecr is configured", func() {
+		images, err := ecrImages(registry.Config{
+			Repository: "registry.corp.local/app/image",
+			ECR:        &registry.ECRConfig{RegistryID: "123456789012"},
+		}, strings.NewReader(dockerfile))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(images).To(ContainElement("registry.corp.local/app/base"))
+	})
+})
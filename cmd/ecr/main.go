@@ -0,0 +1,50 @@
+// Command ecr lists the images a Dockerfile refers to which are hosted by
+// ECR registries, as recognized by check, so that assets/out can pull them
+// with ECR credentials before building.
+//
+//	ecr images DOCKERFILE < request
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/concourse/docker-image-resource/registry"
+)
+
+type Request struct {
+	Source registry.Config `json:"source"`
+}
+
+func main() {
+	if len(os.Args) != 3 || os.Args[1] != "images" {
+		fatal("usage: ecr images DOCKERFILE")
+	}
+
+	var request Request
+	err := json.NewDecoder(os.Stdin).Decode(&request)
+	fatalIf("failed to read request", err)
+
+	dockerfile, err := os.Open(os.Args[2])
+	fatalIf("failed to open Dockerfile", err)
+	defer dockerfile.Close()
+
+	images, err := ecrImages(request.Source, dockerfile)
+	fatalIf("failed to read Dockerfile", err)
+
+	for _, image := range images {
+		fmt.Println(image)
+	}
+}
+
+func fatalIf(doing string, err error) {
+	if err != nil {
+		fatal(doing + ": " + err.Error())
+	}
+}
+
+func fatal(message string) {
+	fmt.Fprintln(os.Stderr, message)
+	os.Exit(1)
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"time"
+
+	"code.cloudfoundry.org/lager/v3/lagertest"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/concourse/docker-image-resource/image"
+	"github.com/concourse/docker-image-resource/registry"
+	"github.com/concourse/docker-image-resource/registry/registrytest"
+)
+
+var _ = Describe("get", func() {
+	var (
+		fakeRegistry *registrytest.Registry
+		destination  string
+		request      InRequest
+		pushed       registrytest.Image
+	)
+
+	BeforeEach(func() {
+		fakeRegistry = registrytest.New()
+		destination = filepath.Join(GinkgoT().TempDir(), "destination")
+
+		pushed = fakeRegistry.PushImage("some/image", "latest", ocispec.Image{
+			Platform: ocispec.Platform{OS: "linux", Architecture: runtime.GOARCH},
+			Config: ocispec.ImageConfig{
+				User: "1000",
+				Env:  []string{"PATH=/usr/bin:/bin", "HOSTNAME=builder"},
+				Labels: map[string]string{
+					"org.opencontainers.image.revision": "some-revision",
+				},
+			},
+		}, registrytest.GzipLayer(
+			registrytest.Dir("etc/"),
+			registrytest.RegularFile("etc/passwd", "some-user:x:1000:1000::/home/some-user:/bin/sh\n"),
+		))
+
+		interval := registry.Duration(time.Millisecond)
+		request = InRequest{
+			Source: Source{
+				Config: registry.Config{
+					Repository: fakeRegistry.Host() + "/some/image",
+					Retry: &registry.RetryPolicy{
+						MaxAttempts:     3,
+						InitialInterval: &interval,
+					},
+				},
+			},
+			Version: Version{Digest: string(pushed.Manifest.Digest)},
+		}
+	})
+
+	AfterEach(func() {
+		fakeRegistry.Close()
+	})
+
+	readFile := func(name string) string {
+		content, err := os.ReadFile(filepath.Join(destination, name))
+		Expect(err).ToNot(HaveOccurred())
+		return string(content)
+	}
+
+	It("writes the image's files without a daemon", func() {
+		response, err := get(lagertest.NewTestLogger("in"), request, destination)
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(readFile("repository")).To(Equal(request.Source.Repository + "\n"))
+		Expect(readFile("tag")).To(Equal("latest\n"))
+		Expect(readFile("digest")).To(Equal(string(pushed.Manifest.Digest) + "\n"))
+		Expect(readFile("image-id")).To(Equal(string(pushed.Config.Digest) + "\n"))
+
+		var inspect []image.Inspect
+		Expect(json.Unmarshal([]byte(readFile("docker_inspect.json")), &inspect)).To(Succeed())
+		Expect(inspect).To(HaveLen(1))
+		Expect(inspect[0].ID).To(Equal(string(pushed.Config.Digest)))
+		Expect(inspect[0].RepoDigests).To(Equal([]string{request.Source.Repository + "@" + string(pushed.Manifest.Digest)}))
+
+		Expect(readFile("metadata.json")).To(MatchJSON(`{"user":"some-user","env":["PATH=/usr/bin:/bin"]}`))
+		Expect(readFile("rootfs/etc/passwd")).To(HavePrefix("some-user:"))
+		Expect(filepath.Join(destination, "rootfs.tar")).ToNot(BeAnExistingFile())
+
+		Expect(digest.FromString(readFile("manifest.json"))).To(Equal(pushed.Manifest.Digest))
+		Expect(digest.FromString(readFile("config.json"))).To(Equal(pushed.Config.Digest))
+		Expect(filepath.Join(destination, "index.json")).ToNot(BeAnExistingFile())
+		Expect(filepath.Join(destination, "index-digest")).ToNot(BeAnExistingFile())
+
+		var layers []image.LayerInfo
+		Expect(json.Unmarshal([]byte(readFile("layers.json")), &layers)).To(Succeed())
+		Expect(layers).To(HaveLen(1))
+		Expect(layers[0].Digest).To(Equal(pushed.Layers[0].Digest))
+		Expect(layers[0].MediaType).To(Equal(ocispec.MediaTypeImageLayerGzip))
+		Expect(layers[0].Size).To(Equal(pushed.Layers[0].Size))
+		Expect(layers[0].UncompressedSize).To(BeNumerically(">", pushed.Layers[0].Size))
+
+		Expect(response).To(Equal(InResponse{
+			Version: request.Version,
+			Metadata: []MetadataField{
+				{Name: "repository", Value: request.Source.Repository},
+				{Name: "tag", Value: "latest"},
+				{Name: "image", Value: string(pushed.Config.Digest)[:12]},
+			},
+		}))
+	})
+
+	It("describes the image's labels, size, layers and platform when metadata_labels is set", func() {
+		request.Params.MetadataLabels = &image.LabelSelector{All: true}
+
+		response, err := get(lagertest.NewTestLogger("in"), request, destination)
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(response.Metadata).To(Equal([]MetadataField{
+			{Name: "repository", Value: request.Source.Repository},
+			{Name: "tag", Value: "latest"},
+			{Name: "image", Value: string(pushed.Config.Digest)[:12]},
+			{Name: "org.opencontainers.image.revision", Value: "some-revision"},
+			{Name: "size", Value: strconv.FormatInt(pushed.Layers[0].Size, 10)},
+			{Name: "layers", Value: "1"},
+			{Name: "platform", Value: "linux/" + runtime.GOARCH},
+		}))
+	})
+
+	It("writes the index when the image is multi-arch", func() {
+		index := fakeRegistry.PushIndex("some/image", "latest", pushed.Manifest)
+		request.Version.Digest = string(index.Digest)
+
+		_, err := get(lagertest.NewTestLogger("in"), request, destination)
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(digest.FromString(readFile("index.json"))).To(Equal(index.Digest))
+		Expect(digest.FromString(readFile("manifest.json"))).To(Equal(pushed.Manifest.Digest))
+	})
+
+	It("writes the digest of the index the tag refers to when a platform is set", func() {
+		index := fakeRegistry.PushIndex("some/image", "latest", pushed.Manifest)
+		request.Source.Platform = &registry.Platform{OS: "linux", Architecture: runtime.GOARCH}
+
+		response, err := get(lagertest.NewTestLogger("in"), request, destination)
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(readFile("digest")).To(Equal(string(pushed.Manifest.Digest) + "\n"))
+		Expect(readFile("index-digest")).To(Equal(string(index.Digest) + "\n"))
+		Expect(response.Metadata).To(ContainElement(MetadataField{Name: "index_digest", Value: string(index.Digest)}))
+	})
+
+	It("writes rootfs.tar when rootfs is set", func() {
+		request.Params.RootFS = true
+
+		_, err := get(lagertest.NewTestLogger("in"), request, destination)
+		Expect(err).ToNot(HaveOccurred())
+
+		rootfsTar, err := os.Open(filepath.Join(destination, "rootfs.tar"))
+		Expect(err).ToNot(HaveOccurred())
+		defer rootfsTar.Close()
+
+		tr := tar.NewReader(rootfsTar)
+
+		header, err := tr.Next()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(header.Name).To(Equal("etc/"))
+
+		header, err = tr.Next()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(header.Name).To(Equal("etc/passwd"))
+	})
+
+	It("writes an OCI layout instead of the rootfs when the format is oci", func() {
+		request.Params.Format = FormatOCI
+
+		_, err := get(lagertest.NewTestLogger("in"), request, destination)
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(filepath.Join(destination, "rootfs")).ToNot(BeAnExistingFile())
+		Expect(readFile("oci/oci-layout")).To(MatchJSON(`{"imageLayoutVersion":"1.0.0"}`))
+		Expect(readFile("oci/index.json")).To(ContainSubstring(string(pushed.Manifest.Digest)))
+
+		for _, layer := range pushed.Layers {
+			Expect(filepath.Join(destination, "oci/blobs/sha256", layer.Digest.Encoded())).To(BeARegularFile())
+		}
+	})
+
+	It("writes an OCI layout archive when the format is oci-archive", func() {
+		request.Params.Format = FormatOCIArchive
+
+		_, err := get(lagertest.NewTestLogger("in"), request, destination)
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(filepath.Join(destination, "rootfs")).ToNot(BeAnExistingFile())
+		Expect(filepath.Join(destination, "image.tar")).To(BeARegularFile())
+	})
+
+	It("fails when the format is unknown", func() {
+		request.Params.Format = "docker"
+
+		_, err := get(lagertest.NewTestLogger("in"), request, destination)
+		Expect(err).To(MatchError("unknown format 'docker': must be one of rootfs, oci or oci-archive"))
+	})
+
+	It("uses the tag of the version over that of the source", func() {
+		request.Source.Tag = "some-tag"
+		request.Version.Tag = "other-tag"
+
+		_, err := get(lagertest.NewTestLogger("in"), request, destination)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(readFile("tag")).To(Equal("other-tag\n"))
+	})
+
+	It("fails when the digest does not exist", func() {
+		request.Version.Digest = "sha256:0000000000000000000000000000000000000000000000000000000000000000"
+
+		_, err := get(lagertest.NewTestLogger("in"), request, destination)
+		Expect(err).To(MatchError(registry.ErrNotFound))
+	})
+
+	Context("when skip_download is set", func() {
+		BeforeEach(func() {
+			request.Params.SkipDownload = true
+			request.Source.Repository = "unreachable.invalid/some/image"
+		})
+
+		It("writes only the repository, tag and digest", func() {
+			response, err := get(lagertest.NewTestLogger("in"), request, destination)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(readFile("digest")).To(Equal(string(pushed.Manifest.Digest) + "\n"))
+			Expect(filepath.Join(destination, "image-id")).ToNot(BeAnExistingFile())
+			Expect(response.Metadata).To(Equal([]MetadataField{
+				{Name: "repository", Value: request.Source.Repository},
+				{Name: "tag", Value: "latest"},
+			}))
+		})
+	})
+
+	It("fails when the image is to be saved", func() {
+		request.Params.Save = true
+
+		_, err := get(lagertest.NewTestLogger("in"), request, destination)
+		Expect(err).To(MatchError("params.save requires the Docker daemon; use params.format: oci-archive instead"))
+	})
+
+	Describe("describe", func() {
+		It("writes the files read from the manifests and returns their metadata", func() {
+			index := fakeRegistry.PushIndex("some/image", "latest", pushed.Manifest)
+			request.Source.Platform = &registry.Platform{OS: "linux", Architecture: runtime.GOARCH}
+			request.Params.MetadataLabels = &image.LabelSelector{Names: []string{"org.opencontainers.image.revision"}}
+
+			fields, err := describe(lagertest.NewTestLogger("in"), request, destination)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(readFile("index-digest")).To(Equal(string(index.Digest) + "\n"))
+			Expect(digest.FromString(readFile("index.json"))).To(Equal(index.Digest))
+			Expect(digest.FromString(readFile("manifest.json"))).To(Equal(pushed.Manifest.Digest))
+			Expect(digest.FromString(readFile("config.json"))).To(Equal(pushed.Config.Digest))
+			Expect(readFile("layers.json")).ToNot(ContainSubstring("uncompressed_size"))
+			Expect(filepath.Join(destination, "rootfs")).ToNot(BeAnExistingFile())
+			Expect(fields).To(Equal([]MetadataField{
+				{Name: "index_digest", Value: string(index.Digest)},
+				{Name: "org.opencontainers.image.revision", Value: "some-revision"},
+				{Name: "size", Value: strconv.FormatInt(pushed.Layers[0].Size, 10)},
+				{Name: "layers", Value: "1"},
+				{Name: "platform", Value: "linux/" + runtime.GOARCH},
+			}))
+		})
+	})
+})
@@ -0,0 +1,354 @@
+// Command in fetches an image from its registry without a Docker daemon, for
+// assets/in to delegate to when params.daemonless is set.
+//
+// With -manifests-only, only the image's manifests are fetched, for assets/in
+// to describe an image it has pulled with a Docker daemon: the files read
+// from them are written, and the metadata fields they add to the response
+// are printed.
+//
+//	in [-manifests-only] DESTINATION < request
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"code.cloudfoundry.org/lager/v3"
+	"github.com/concourse/docker-image-resource/image"
+	"github.com/concourse/docker-image-resource/registry"
+	"github.com/concourse/docker-image-resource/rootfs"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var manifestsOnly = flag.Bool("manifests-only", false, "only fetch the image's manifests, and print the metadata fields read from them")
+
+func main() {
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		fatal("usage: in [-manifests-only] DESTINATION")
+	}
+
+	var request InRequest
+	err := json.NewDecoder(os.Stdin).Decode(&request)
+	fatalIf("failed to read request", err)
+
+	logLevel := lager.INFO
+	if request.Source.Debug {
+		logLevel = lager.DEBUG
+	}
+
+	logger := lager.NewLogger("http")
+	logger.RegisterSink(lager.NewPrettySink(os.Stderr, logLevel))
+
+	if *manifestsOnly {
+		fields, err := describe(logger, request, flag.Arg(0))
+		fatalIf("failed to describe image", err)
+
+		json.NewEncoder(os.Stdout).Encode(fields)
+		return
+	}
+
+	response, err := get(logger, request, flag.Arg(0))
+	fatalIf("failed to fetch image", err)
+
+	json.NewEncoder(os.Stdout).Encode(response)
+}
+
+// get fetches the requested version of the image into the destination,
+// writing the same files as assets/in does with a Docker daemon.
+func get(logger lager.Logger, request InRequest, destination string) (InResponse, error) {
+	if request.Params.Save {
+		return InResponse{}, errors.New("params.save requires the Docker daemon; use params.format: oci-archive instead")
+	}
+
+	switch request.Params.Format {
+	case "", FormatRootFS, FormatOCI, FormatOCIArchive:
+	default:
+		return InResponse{}, fmt.Errorf("unknown format '%s': must be one of %s, %s or %s", request.Params.Format, FormatRootFS, FormatOCI, FormatOCIArchive)
+	}
+
+	tag := requestTag(request)
+
+	if err := os.MkdirAll(destination, 0755); err != nil {
+		return InResponse{}, err
+	}
+
+	var (
+		imageID string
+		img     *image.Image
+	)
+	if !request.Params.SkipDownload {
+		var err error
+		img, err = fetch(logger, request, tag, destination)
+		if err != nil {
+			return InResponse{}, err
+		}
+
+		imageID = string(img.ID())
+	}
+
+	files := map[string]string{
+		"repository": request.Source.Repository,
+		"tag":        tag,
+		"digest":     request.Version.Digest,
+	}
+	for name, content := range files {
+		if err := writeFile(destination, name, content+"\n"); err != nil {
+			return InResponse{}, err
+		}
+	}
+
+	response := InResponse{Version: request.Version}
+	for _, field := range []MetadataField{
+		{Name: "repository", Value: request.Source.Repository},
+		{Name: "tag", Value: tag},
+		{Name: "image", Value: imageID[:min(12, len(imageID))]},
+	} {
+		if field.Value != "" {
+			response.Metadata = append(response.Metadata, field)
+		}
+	}
+
+	if img != nil {
+		response.Metadata = append(response.Metadata, imageMetadata(request, img)...)
+	}
+
+	return response, nil
+}
+
+// describe fetches the image's manifests to write the files read from them
+// (manifest.json, config.json, index.json, index-digest and layers.json),
+// returning the metadata fields they add to the response.
+func describe(logger lager.Logger, request InRequest, destination string) ([]MetadataField, error) {
+	if err := os.MkdirAll(destination, 0755); err != nil {
+		return nil, err
+	}
+
+	img, _, err := fetchManifests(logger, request, requestTag(request), destination)
+	if err != nil {
+		return nil, err
+	}
+
+	// the layers are not downloaded, so their uncompressed sizes are unknown
+	if err := writeJSON(destination, "layers.json", img.LayerInfo()); err != nil {
+		return nil, err
+	}
+
+	return imageMetadata(request, img), nil
+}
+
+// imageMetadata returns the metadata fields describing the image beyond its
+// repository, tag and ID.
+func imageMetadata(request InRequest, img *image.Image) []MetadataField {
+	fields := []MetadataField{}
+
+	if img.Index != nil {
+		fields = append(fields, MetadataField{Name: "index_digest", Value: string(img.Index.Digest)})
+	}
+
+	if request.Params.MetadataLabels != nil {
+		fields = append(fields, img.MetadataFields(*request.Params.MetadataLabels)...)
+	}
+
+	return fields
+}
+
+func requestTag(request InRequest) string {
+	if request.Version.Tag != "" {
+		return request.Version.Tag
+	}
+
+	if request.Source.Tag != "" {
+		return string(request.Source.Tag)
+	}
+
+	return "latest"
+}
+
+// fetchManifests fetches the image's manifests and config, looking up the
+// index the tag refers to if a platform's manifest was checked, and writes
+// them as manifest.json, config.json and, if the image is multi-arch,
+// index.json and index-digest.
+func fetchManifests(logger lager.Logger, request InRequest, tag string, destination string) (*image.Image, *registry.Client, error) {
+	client, err := registry.NewClient(logger, request.Source.Config)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to registry: %w", err)
+	}
+
+	platform := registry.Platform{OS: "linux", Architecture: runtime.GOARCH}
+	if request.Source.Platform != nil {
+		platform = *request.Source.Platform
+	}
+
+	img, err := image.Fetch(client, digest.Digest(request.Version.Digest), platform)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if request.Source.Platform != nil {
+		if err := img.FindIndex(client, tag); err != nil {
+			return nil, nil, fmt.Errorf("failed to look up index of tag '%s': %w", tag, err)
+		}
+	}
+
+	// written as fetched, so that they can be verified against their digests
+	raw := map[string][]byte{
+		"manifest.json": img.Manifest.Body,
+		"config.json":   img.Config,
+	}
+	if img.Index != nil {
+		raw["index.json"] = img.Index.Body
+		raw["index-digest"] = []byte(string(img.Index.Digest) + "\n")
+	}
+	for name, content := range raw {
+		if err := writeFile(destination, name, string(content)); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return img, client, nil
+}
+
+// fetch fetches the image and writes image-id, docker_inspect.json,
+// metadata.json, the registry's view of the image (manifest.json,
+// config.json, index.json and layers.json) and the image itself in the
+// requested format.
+func fetch(logger lager.Logger, request InRequest, tag string, destination string) (*image.Image, error) {
+	img, client, err := fetchManifests(logger, request, tag, destination)
+	if err != nil {
+		return nil, err
+	}
+
+	// layers are downloaded straight into the OCI layout, if it is to be
+	// written
+	var layersDir string
+	if request.Params.Format == FormatOCI {
+		layersDir = filepath.Join(destination, "oci", ocispec.ImageBlobsDir)
+	} else {
+		layersDir, err = os.MkdirTemp("", "layers")
+		if err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(layersDir)
+	}
+
+	if err := img.DownloadLayers(client, layersDir); err != nil {
+		return nil, err
+	}
+
+	if err := writeFile(destination, "image-id", string(img.ID())+"\n"); err != nil {
+		return nil, err
+	}
+
+	if err := writeJSON(destination, "docker_inspect.json", []image.Inspect{img.Inspect(request.Source.Repository, tag)}); err != nil {
+		return nil, err
+	}
+
+	metadata, err := img.Metadata()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image metadata: %w", err)
+	}
+
+	if err := writeJSON(destination, "metadata.json", metadata); err != nil {
+		return nil, err
+	}
+
+	if err := writeJSON(destination, "layers.json", img.LayerInfo()); err != nil {
+		return nil, err
+	}
+
+	layers := make([]rootfs.Layer, len(img.Layers))
+	for i, layer := range img.Layers {
+		layers[i] = layer
+	}
+
+	switch request.Params.Format {
+	case "", FormatRootFS:
+		// devices cannot be created without privileges, and are of no use in
+		// the rootfs directory anyway
+		err = rootfs.Unpack(filepath.Join(destination, "rootfs"), layers, rootfs.Options{
+			SkipDevices: true,
+			Chown:       os.Geteuid() == 0,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to unpack rootfs: %w", err)
+		}
+
+	case FormatOCI:
+		if err := img.WriteLayout(filepath.Join(destination, "oci"), tag); err != nil {
+			return nil, fmt.Errorf("failed to write OCI layout: %w", err)
+		}
+
+	case FormatOCIArchive:
+		if err := writeOCIArchive(filepath.Join(destination, "image.tar"), img, tag); err != nil {
+			return nil, fmt.Errorf("failed to write OCI archive: %w", err)
+		}
+	}
+
+	if request.Params.RootFS {
+		if err := writeRootFSTar(filepath.Join(destination, "rootfs.tar"), layers); err != nil {
+			return nil, fmt.Errorf("failed to write rootfs.tar: %w", err)
+		}
+	}
+
+	return img, nil
+}
+
+func writeRootFSTar(path string, layers []rootfs.Layer) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := rootfs.WriteTar(file, layers, rootfs.Options{}); err != nil {
+		return err
+	}
+
+	return file.Close()
+}
+
+func writeOCIArchive(path string, img *image.Image, tag string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := img.WriteLayoutTar(file, tag); err != nil {
+		return err
+	}
+
+	return file.Close()
+}
+
+func writeFile(destination string, name string, content string) error {
+	return os.WriteFile(filepath.Join(destination, name), []byte(content), 0644)
+}
+
+func writeJSON(destination string, name string, v any) error {
+	content, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	return writeFile(destination, name, string(content)+"\n")
+}
+
+func fatalIf(doing string, err error) {
+	if err != nil {
+		fatal(doing + ": " + err.Error())
+	}
+}
+
+func fatal(message string) {
+	fmt.Fprintln(os.Stderr, message)
+	os.Exit(1)
+}
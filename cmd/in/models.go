@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/concourse/docker-image-resource/image"
+	"github.com/concourse/docker-image-resource/registry"
+)
+
+type Source struct {
+	registry.Config
+
+	Tag      Tag                `json:"tag"`
+	Platform *registry.Platform `json:"platform"`
+}
+
+type Params struct {
+	SkipDownload   bool                 `json:"skip_download"`
+	Save           bool                 `json:"save"`
+	RootFS         bool                 `json:"rootfs"`
+	Format         string               `json:"format"`
+	MetadataLabels *image.LabelSelector `json:"metadata_labels"`
+}
+
+// Formats the image can be written in.
+const (
+	FormatRootFS     = "rootfs"
+	FormatOCI        = "oci"
+	FormatOCIArchive = "oci-archive"
+)
+
+type Version struct {
+	Digest string `json:"digest"`
+	Tag    string `json:"tag,omitempty"`
+}
+
+type InRequest struct {
+	Source  Source  `json:"source"`
+	Params  Params  `json:"params"`
+	Version Version `json:"version"`
+}
+
+type MetadataField = image.MetadataField
+
+type InResponse struct {
+	Version  Version         `json:"version"`
+	Metadata []MetadataField `json:"metadata"`
+}
+
+// Tag refers to a tag for an image in the registry.
+type Tag string
+
+// UnmarshalJSON accepts numeric and string values.
+func (tag *Tag) UnmarshalJSON(b []byte) (err error) {
+	var s string
+	if err = json.Unmarshal(b, &s); err == nil {
+		*tag = Tag(s)
+	} else {
+		var n json.RawMessage
+		if err = json.Unmarshal(b, &n); err == nil {
+			*tag = Tag(n)
+		}
+	}
+	return err
+}
@@ -0,0 +1,93 @@
+// Command metadata-fields prints the metadata fields selected by
+// params.metadata_labels for an image in the registry of source.repository,
+// for assets/in and assets/out to add to their response. Only the image's
+// manifest and config are fetched.
+//
+//	metadata-fields DIGEST < request
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+
+	"code.cloudfoundry.org/lager/v3"
+	"github.com/concourse/docker-image-resource/image"
+	"github.com/concourse/docker-image-resource/registry"
+	digest "github.com/opencontainers/go-digest"
+)
+
+type Source struct {
+	registry.Config
+
+	Platform *registry.Platform `json:"platform"`
+}
+
+type Params struct {
+	MetadataLabels *image.LabelSelector `json:"metadata_labels"`
+}
+
+type Request struct {
+	Source Source `json:"source"`
+	Params Params `json:"params"`
+}
+
+func main() {
+	if len(os.Args) != 2 {
+		fatal("usage: metadata-fields DIGEST")
+	}
+
+	var request Request
+	err := json.NewDecoder(os.Stdin).Decode(&request)
+	fatalIf("failed to read request", err)
+
+	logLevel := lager.INFO
+	if request.Source.Debug {
+		logLevel = lager.DEBUG
+	}
+
+	logger := lager.NewLogger("http")
+	logger.RegisterSink(lager.NewPrettySink(os.Stderr, logLevel))
+
+	fields, err := metadataFields(logger, request, digest.Digest(os.Args[1]))
+	fatalIf("failed to describe image", err)
+
+	json.NewEncoder(os.Stdout).Encode(fields)
+}
+
+// metadataFields fetches the image's manifest and config to describe it,
+// unless no labels were selected, in which case nothing is fetched.
+func metadataFields(logger lager.Logger, request Request, ref digest.Digest) ([]image.MetadataField, error) {
+	if request.Params.MetadataLabels == nil {
+		return []image.MetadataField{}, nil
+	}
+
+	client, err := registry.NewClient(logger, request.Source.Config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to registry: %w", err)
+	}
+
+	platform := registry.Platform{OS: "linux", Architecture: runtime.GOARCH}
+	if request.Source.Platform != nil {
+		platform = *request.Source.Platform
+	}
+
+	img, err := image.Fetch(client, ref, platform)
+	if err != nil {
+		return nil, err
+	}
+
+	return img.MetadataFields(*request.Params.MetadataLabels), nil
+}
+
+func fatalIf(doing string, err error) {
+	if err != nil {
+		fatal(doing + ": " + err.Error())
+	}
+}
+
+func fatal(message string) {
+	fmt.Fprintln(os.Stderr, message)
+	os.Exit(1)
+}
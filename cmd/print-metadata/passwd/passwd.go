@@ -3,6 +3,7 @@ package passwd
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"os"
 	"strconv"
 	"strings"
@@ -31,7 +32,12 @@ func ReadUsers(path string) (Users, error) {
 	}
 	defer file.Close()
 
-	userScanner := bufio.NewScanner(file)
+	return ParseUsers(file)
+}
+
+// ParseUsers reads users in the format of /etc/passwd.
+func ParseUsers(reader io.Reader) (Users, error) {
+	userScanner := bufio.NewScanner(reader)
 
 	users := []User{}
 	lineCount := 0
@@ -56,5 +62,8 @@ func ReadUsers(path string) (Users, error) {
 			ID:       userID,
 		})
 	}
+	if err := userScanner.Err(); err != nil {
+		return nil, err
+	}
 	return users, nil
 }
@@ -0,0 +1,224 @@
+// Package image pulls images from a registry without a Docker daemon,
+// verifying everything it fetches against the digests it is referenced by.
+package image
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/concourse/docker-image-resource/registry"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Image is the manifest and config of an image, as referenced by a digest.
+type Image struct {
+	// Index is the image index (or manifest list) the manifest was selected
+	// from, if the image is multi-arch.
+	Index *registry.Manifest
+
+	Manifest registry.Manifest
+	Config   []byte
+
+	// Layers are the image's layers, once downloaded.
+	Layers []Layer
+
+	manifest ocispec.Manifest
+	config   ocispec.Image
+	// ref is the digest the image was fetched by
+	ref digest.Digest
+}
+
+// Fetch fetches the manifest referenced by a digest and the config it
+// refers to. When the digest refers to an index, the manifest of the given
+// platform is selected from it.
+func Fetch(client *registry.Client, ref digest.Digest, platform registry.Platform) (*Image, error) {
+	if err := ref.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid digest '%s': %w", ref, err)
+	}
+
+	manifest, err := fetchManifest(client, ocispec.Descriptor{Digest: ref, Size: -1})
+	if err != nil {
+		return nil, err
+	}
+
+	image := &Image{ref: ref}
+
+	if manifest.IsIndex() {
+		var index ocispec.Index
+		if err := json.Unmarshal(manifest.Body, &index); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal image index: %w", err)
+		}
+
+		platformManifest, found := platform.SelectManifest(index.Manifests)
+		if !found {
+			return nil, fmt.Errorf("no manifest for platform %s found in index %s", platform, ref)
+		}
+
+		indexManifest := manifest
+		image.Index = &indexManifest
+
+		manifest, err = fetchManifest(client, platformManifest)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch manifest.MediaType {
+	case registry.MediaTypeDockerManifest, ocispec.MediaTypeImageManifest:
+	default:
+		return nil, fmt.Errorf("unsupported manifest media type '%s'", manifest.MediaType)
+	}
+
+	image.Manifest = manifest
+
+	if err := json.Unmarshal(manifest.Body, &image.manifest); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal manifest: %w", err)
+	}
+
+	image.Config, err = fetchBlob(client, image.manifest.Config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch config: %w", err)
+	}
+
+	if err := json.Unmarshal(image.Config, &image.config); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal config: %w", err)
+	}
+
+	if len(image.config.RootFS.DiffIDs) != len(image.manifest.Layers) {
+		return nil, fmt.Errorf("config lists %d diff IDs for %d layers", len(image.config.RootFS.DiffIDs), len(image.manifest.Layers))
+	}
+
+	return image, nil
+}
+
+// FindIndex looks up the index the tag refers to and records it as the
+// image's index if it lists the image's manifest, as is the case for an image
+// fetched by the digest check selects from an index for a platform. The
+// index is left unset if the tag no longer refers to an index listing the
+// manifest, e.g. because it has been pushed again since.
+func (image *Image) FindIndex(client *registry.Client, tag string) error {
+	if image.Index != nil {
+		return nil
+	}
+
+	manifest, err := client.GetManifest(tag)
+	if errors.Is(err, registry.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if !manifest.IsIndex() {
+		return nil
+	}
+
+	if actual := digest.FromBytes(manifest.Body); actual != manifest.Digest {
+		return &DigestError{Expected: manifest.Digest, Actual: actual}
+	}
+
+	var index ocispec.Index
+	if err := json.Unmarshal(manifest.Body, &index); err != nil {
+		return fmt.Errorf("failed to unmarshal image index: %w", err)
+	}
+
+	for _, descriptor := range index.Manifests {
+		if descriptor.Digest == image.Manifest.Digest {
+			image.Index = &manifest
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// ID returns the ID Docker knows the image by, i.e. the digest of its config.
+func (image *Image) ID() digest.Digest {
+	return image.manifest.Config.Digest
+}
+
+// ConfigFile returns the image's config.
+func (image *Image) ConfigFile() ocispec.Image {
+	return image.config
+}
+
+// LayerDescriptors returns the descriptors of the image's layers, in order.
+func (image *Image) LayerDescriptors() []ocispec.Descriptor {
+	return image.manifest.Layers
+}
+
+// fetchManifest fetches a manifest and verifies it against its descriptor.
+// A negative size is not verified.
+func fetchManifest(client *registry.Client, descriptor ocispec.Descriptor) (registry.Manifest, error) {
+	manifest, err := client.GetManifest(string(descriptor.Digest))
+	if err != nil {
+		return registry.Manifest{}, fmt.Errorf("failed to fetch manifest %s: %w", descriptor.Digest, err)
+	}
+
+	if descriptor.Size >= 0 && int64(len(manifest.Body)) != descriptor.Size {
+		return registry.Manifest{}, fmt.Errorf("manifest %s: expected %d bytes, got %d", descriptor.Digest, descriptor.Size, len(manifest.Body))
+	}
+
+	if actual := descriptor.Digest.Algorithm().FromBytes(manifest.Body); actual != descriptor.Digest {
+		return registry.Manifest{}, &DigestError{Expected: descriptor.Digest, Actual: actual}
+	}
+
+	// the digest reported by the registry is not to be trusted
+	manifest.Digest = descriptor.Digest
+
+	return manifest, nil
+}
+
+// fetchBlob fetches a small blob, e.g. a config, into memory and verifies it
+// against its descriptor.
+func fetchBlob(client *registry.Client, descriptor ocispec.Descriptor) ([]byte, error) {
+	if err := descriptor.Digest.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid digest '%s': %w", descriptor.Digest, err)
+	}
+
+	blob, err := client.GetBlob(descriptor.Digest)
+	if err != nil {
+		return nil, err
+	}
+	defer blob.Close()
+
+	content, err := io.ReadAll(io.LimitReader(blob, descriptor.Size+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read blob %s: %w", descriptor.Digest, err)
+	}
+
+	if int64(len(content)) != descriptor.Size {
+		return nil, &SizeError{Digest: descriptor.Digest, Expected: descriptor.Size}
+	}
+
+	if actual := descriptor.Digest.Algorithm().FromBytes(content); actual != descriptor.Digest {
+		return nil, &DigestError{Expected: descriptor.Digest, Actual: actual}
+	}
+
+	return content, nil
+}
+
+// DigestError is returned when content does not match the digest it was
+// fetched by.
+type DigestError struct {
+	Expected digest.Digest
+	Actual   digest.Digest
+}
+
+func (err *DigestError) Error() string {
+	return fmt.Sprintf("digest mismatch: expected %s, got %s", err.Expected, err.Actual)
+}
+
+// SizeError is returned when a blob is not of the size its descriptor
+// declares.
+type SizeError struct {
+	Digest   digest.Digest
+	Expected int64
+}
+
+func (err *SizeError) Error() string {
+	return fmt.Sprintf("blob %s is not the expected %d bytes long", err.Digest, err.Expected)
+}
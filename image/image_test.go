@@ -0,0 +1,709 @@
+package image_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"time"
+
+	"code.cloudfoundry.org/lager/v3/lagertest"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/concourse/docker-image-resource/image"
+	"github.com/concourse/docker-image-resource/registry"
+	"github.com/concourse/docker-image-resource/registry/registrytest"
+)
+
+var _ = Describe("Image", func() {
+	var (
+		fakeRegistry *registrytest.Registry
+		repository   string
+		client       *registry.Client
+		layersDir    string
+
+		config ocispec.Image
+		layers []registrytest.Layer
+		pushed registrytest.Image
+	)
+
+	BeforeEach(func() {
+		fakeRegistry = registrytest.New()
+		repository = fakeRegistry.Host() + "/some/image"
+
+		interval := registry.Duration(time.Millisecond)
+
+		var err error
+		client, err = registry.NewClient(lagertest.NewTestLogger("image"), registry.Config{
+			Repository: repository,
+			Retry: &registry.RetryPolicy{
+				MaxAttempts:     3,
+				InitialInterval: &interval,
+			},
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		layersDir = GinkgoT().TempDir()
+
+		config = ocispec.Image{
+			Platform: ocispec.Platform{OS: "linux", Architecture: runtime.GOARCH},
+			Config: ocispec.ImageConfig{
+				Env: []string{"PATH=/usr/bin:/bin", "HOSTNAME=builder", "FOO=bar"},
+			},
+		}
+
+		layers = []registrytest.Layer{
+			registrytest.GzipLayer(
+				registrytest.Dir("etc/"),
+				registrytest.RegularFile("etc/passwd", "root:x:0:0:root:/root:/bin/sh\nsome-user:x:1000:1000::/home/some-user:/bin/sh\n"),
+			),
+			registrytest.ZstdLayer(registrytest.RegularFile("some-file", "some-content")),
+			registrytest.UncompressedLayer(registrytest.RegularFile("other-file", "other-content")),
+		}
+	})
+
+	JustBeforeEach(func() {
+		pushed = fakeRegistry.PushImage("some/image", "latest", config, layers...)
+	})
+
+	AfterEach(func() {
+		fakeRegistry.Close()
+	})
+
+	Describe("Fetch", func() {
+		It("fetches the manifest and config", func() {
+			img, err := image.Fetch(client, pushed.Manifest.Digest, registry.Platform{})
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(img.Index).To(BeNil())
+			Expect(img.Manifest.Digest).To(Equal(pushed.Manifest.Digest))
+			Expect(img.Manifest.MediaType).To(Equal(ocispec.MediaTypeImageManifest))
+			Expect(img.Digest()).To(Equal(pushed.Manifest.Digest))
+			Expect(img.ID()).To(Equal(pushed.Config.Digest))
+			Expect(digest.FromBytes(img.Config)).To(Equal(pushed.Config.Digest))
+			Expect(img.LayerDescriptors()).To(Equal(pushed.Layers))
+		})
+
+		It("fails when the digest is invalid", func() {
+			_, err := image.Fetch(client, "some-digest", registry.Platform{})
+			Expect(err).To(MatchError(ContainSubstring("invalid digest 'some-digest'")))
+		})
+
+		It("fails when the manifest does not exist", func() {
+			_, err := image.Fetch(client, digest.FromString("missing"), registry.Platform{})
+			Expect(err).To(MatchError(registry.ErrNotFound))
+		})
+
+		It("fails when the config does not match its digest", func() {
+			fakeRegistry.ReplaceBlob(pushed.Config.Digest, bytes.Repeat([]byte(" "), int(pushed.Config.Size)))
+
+			_, err := image.Fetch(client, pushed.Manifest.Digest, registry.Platform{})
+
+			var digestErr *image.DigestError
+			Expect(errors.As(err, &digestErr)).To(BeTrue(), "%v", err)
+			Expect(digestErr.Expected).To(Equal(pushed.Config.Digest))
+		})
+
+		Context("when the config does not list a diff ID for each layer", func() {
+			BeforeEach(func() {
+				config.RootFS.DiffIDs = []digest.Digest{layers[0].DiffID}
+			})
+
+			It("fails", func() {
+				_, err := image.Fetch(client, pushed.Manifest.Digest, registry.Platform{})
+				Expect(err).To(MatchError("config lists 1 diff IDs for 3 layers"))
+			})
+		})
+
+		Context("when the digest refers to an index", func() {
+			var index ocispec.Descriptor
+
+			JustBeforeEach(func() {
+				otherConfig := config
+				otherConfig.Architecture = "other-arch"
+				other := fakeRegistry.PushImage("some/image", "", otherConfig, layers...)
+
+				index = fakeRegistry.PushIndex("some/image", "latest", other.Manifest, pushed.Manifest)
+			})
+
+			It("selects the platform's manifest", func() {
+				img, err := image.Fetch(client, index.Digest, registry.Platform{OS: "linux", Architecture: runtime.GOARCH})
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(img.Index).ToNot(BeNil())
+				Expect(img.Index.Digest).To(Equal(index.Digest))
+				Expect(img.Index.MediaType).To(Equal(ocispec.MediaTypeImageIndex))
+				Expect(img.Manifest.Digest).To(Equal(pushed.Manifest.Digest))
+				Expect(img.Digest()).To(Equal(index.Digest))
+				Expect(img.ID()).To(Equal(pushed.Config.Digest))
+			})
+
+			It("fails when no manifest matches the platform", func() {
+				_, err := image.Fetch(client, index.Digest, registry.Platform{OS: "windows", Architecture: "amd64"})
+				Expect(err).To(MatchError("no manifest for platform windows/amd64 found in index " + string(index.Digest)))
+			})
+		})
+	})
+
+	Describe("FindIndex", func() {
+		It("leaves the index unset when the tag refers to a manifest", func() {
+			img, err := image.Fetch(client, pushed.Manifest.Digest, registry.Platform{})
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(img.FindIndex(client, "latest")).To(Succeed())
+			Expect(img.Index).To(BeNil())
+		})
+
+		It("leaves the index unset when the tag does not exist", func() {
+			img, err := image.Fetch(client, pushed.Manifest.Digest, registry.Platform{})
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(img.FindIndex(client, "missing")).To(Succeed())
+			Expect(img.Index).To(BeNil())
+		})
+
+		Context("when the tag refers to an index", func() {
+			var other registrytest.Image
+
+			JustBeforeEach(func() {
+				otherConfig := config
+				otherConfig.Architecture = "other-arch"
+				other = fakeRegistry.PushImage("some/image", "", otherConfig, layers...)
+			})
+
+			It("records the index when it lists the manifest", func() {
+				index := fakeRegistry.PushIndex("some/image", "latest", other.Manifest, pushed.Manifest)
+
+				img, err := image.Fetch(client, pushed.Manifest.Digest, registry.Platform{})
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(img.FindIndex(client, "latest")).To(Succeed())
+				Expect(img.Index).ToNot(BeNil())
+				Expect(img.Index.Digest).To(Equal(index.Digest))
+				Expect(img.Digest()).To(Equal(index.Digest))
+			})
+
+			It("leaves the index unset when it does not list the manifest", func() {
+				fakeRegistry.PushIndex("some/image", "latest", other.Manifest)
+
+				img, err := image.Fetch(client, pushed.Manifest.Digest, registry.Platform{})
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(img.FindIndex(client, "latest")).To(Succeed())
+				Expect(img.Index).To(BeNil())
+			})
+		})
+	})
+
+	Describe("DownloadLayers", func() {
+		var img *image.Image
+
+		JustBeforeEach(func() {
+			var err error
+			img, err = image.Fetch(client, pushed.Manifest.Digest, registry.Platform{})
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("downloads and verifies gzip, zstd and uncompressed layers", func() {
+			Expect(img.DownloadLayers(client, layersDir)).To(Succeed())
+
+			Expect(img.Layers).To(HaveLen(3))
+			for i, layer := range img.Layers {
+				Expect(layer.Descriptor).To(Equal(pushed.Layers[i]))
+				Expect(layer.DiffID).To(Equal(layers[i].DiffID))
+				Expect(layer.UncompressedSize).To(BeNumerically(">", 0))
+				Expect(layer.Path).To(Equal(filepath.Join(layersDir, "sha256", layer.Digest.Encoded())))
+
+				blob, err := os.ReadFile(layer.Path)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(blob).To(Equal(layers[i].Blob))
+			}
+
+			Expect(img.Layers[2].UncompressedSize).To(BeNumerically("==", len(layers[2].Blob)))
+		})
+
+		It("fails when a layer does not match its digest", func() {
+			corrupted := append([]byte{}, layers[1].Blob...)
+			corrupted[len(corrupted)-1] ^= 0xff
+			fakeRegistry.ReplaceBlob(pushed.Layers[1].Digest, corrupted)
+
+			err := img.DownloadLayers(client, layersDir)
+
+			var digestErr *image.DigestError
+			Expect(errors.As(err, &digestErr)).To(BeTrue(), "%v", err)
+			Expect(digestErr.Expected).To(Equal(pushed.Layers[1].Digest))
+			Expect(digestErr.Actual).To(Equal(digest.FromBytes(corrupted)))
+		})
+
+		It("fails when a layer is not of the declared size", func() {
+			fakeRegistry.ReplaceBlob(pushed.Layers[1].Digest, append(layers[1].Blob, 0))
+
+			err := img.DownloadLayers(client, layersDir)
+
+			var sizeErr *image.SizeError
+			Expect(errors.As(err, &sizeErr)).To(BeTrue(), "%v", err)
+			Expect(sizeErr.Digest).To(Equal(pushed.Layers[1].Digest))
+		})
+
+		Context("when a diff ID does not match the layer's content", func() {
+			BeforeEach(func() {
+				config.RootFS.DiffIDs = []digest.Digest{layers[0].DiffID, layers[2].DiffID, layers[2].DiffID}
+			})
+
+			It("fails", func() {
+				err := img.DownloadLayers(client, layersDir)
+
+				var digestErr *image.DigestError
+				Expect(errors.As(err, &digestErr)).To(BeTrue(), "%v", err)
+				Expect(digestErr.Expected).To(Equal(layers[2].DiffID))
+				Expect(digestErr.Actual).To(Equal(layers[1].DiffID))
+			})
+		})
+	})
+
+	Describe("LayerInfo", func() {
+		var img *image.Image
+
+		JustBeforeEach(func() {
+			var err error
+			img, err = image.Fetch(client, pushed.Manifest.Digest, registry.Platform{})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(img.DownloadLayers(client, layersDir)).To(Succeed())
+		})
+
+		Context("when the config records the history of each layer", func() {
+			BeforeEach(func() {
+				config.History = []ocispec.History{
+					{CreatedBy: "ADD passwd /etc/passwd"},
+					{CreatedBy: "ENV FOO=bar", EmptyLayer: true},
+					{CreatedBy: "ADD some-file /", Comment: "some-comment"},
+					{CreatedBy: "ADD other-file /"},
+				}
+			})
+
+			It("describes each layer along with the history entry which created it", func() {
+				infos := img.LayerInfo()
+				Expect(infos).To(HaveLen(3))
+
+				for i, info := range infos {
+					Expect(info.Digest).To(Equal(pushed.Layers[i].Digest))
+					Expect(info.MediaType).To(Equal(pushed.Layers[i].MediaType))
+					Expect(info.Size).To(Equal(pushed.Layers[i].Size))
+					Expect(info.UncompressedSize).To(Equal(img.Layers[i].UncompressedSize))
+					Expect(info.DiffID).To(Equal(layers[i].DiffID))
+				}
+
+				Expect(infos[0].History).To(Equal(&ocispec.History{CreatedBy: "ADD passwd /etc/passwd"}))
+				Expect(infos[1].History).To(Equal(&ocispec.History{CreatedBy: "ADD some-file /", Comment: "some-comment"}))
+				Expect(infos[2].History).To(Equal(&ocispec.History{CreatedBy: "ADD other-file /"}))
+			})
+		})
+
+		It("leaves the uncompressed sizes out until the layers are downloaded", func() {
+			img, err := image.Fetch(client, pushed.Manifest.Digest, registry.Platform{})
+			Expect(err).ToNot(HaveOccurred())
+
+			infos := img.LayerInfo()
+			Expect(infos).To(HaveLen(3))
+
+			for i, info := range infos {
+				Expect(info.Digest).To(Equal(pushed.Layers[i].Digest))
+				Expect(info.Size).To(Equal(pushed.Layers[i].Size))
+				Expect(info.UncompressedSize).To(BeZero())
+				Expect(info.DiffID).To(Equal(layers[i].DiffID))
+			}
+		})
+
+		Context("when the history does not match the layers", func() {
+			BeforeEach(func() {
+				config.History = []ocispec.History{{CreatedBy: "ADD rootfs.tar /"}}
+			})
+
+			It("leaves the history out", func() {
+				for _, info := range img.LayerInfo() {
+					Expect(info.History).To(BeNil())
+				}
+			})
+		})
+	})
+
+	Describe("Inspect", func() {
+		BeforeEach(func() {
+			created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+			config.Created = &created
+			config.Author = "some-author"
+			config.Config.User = "some-user"
+		})
+
+		It("describes the image as docker inspect does", func() {
+			img, err := image.Fetch(client, pushed.Manifest.Digest, registry.Platform{})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(img.DownloadLayers(client, layersDir)).To(Succeed())
+
+			inspect := img.Inspect(repository, "latest")
+			Expect(inspect.ID).To(Equal(string(pushed.Config.Digest)))
+			Expect(inspect.RepoTags).To(Equal([]string{repository + ":latest"}))
+			Expect(inspect.RepoDigests).To(Equal([]string{repository + "@" + string(pushed.Manifest.Digest)}))
+			Expect(inspect.Created).To(Equal(config.Created))
+			Expect(inspect.Author).To(Equal("some-author"))
+			Expect(inspect.Config).To(Equal(config.Config))
+			Expect(inspect.Os).To(Equal("linux"))
+			Expect(inspect.Architecture).To(Equal(runtime.GOARCH))
+			Expect(inspect.RootFS.Type).To(Equal("layers"))
+			Expect(inspect.RootFS.Layers).To(Equal([]digest.Digest{layers[0].DiffID, layers[1].DiffID, layers[2].DiffID}))
+
+			var size int64
+			for _, layer := range img.Layers {
+				size += layer.UncompressedSize
+			}
+			Expect(inspect.Size).To(Equal(size))
+		})
+	})
+
+	Describe("MetadataFields", func() {
+		BeforeEach(func() {
+			created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+			config.Created = &created
+			config.Variant = "v8"
+			config.Config.Labels = map[string]string{
+				"org.opencontainers.image.source":   "https://example.com/some/repo",
+				"org.opencontainers.image.revision": "some-revision",
+			}
+		})
+
+		var facts []image.MetadataField
+
+		JustBeforeEach(func() {
+			var size int
+			for _, layer := range layers {
+				size += len(layer.Blob)
+			}
+
+			facts = []image.MetadataField{
+				{Name: "size", Value: strconv.Itoa(size)},
+				{Name: "layers", Value: "3"},
+				{Name: "created", Value: "2024-01-02T03:04:05Z"},
+				{Name: "platform", Value: "linux/" + runtime.GOARCH + "/v8"},
+			}
+		})
+
+		It("describes the selected labels in the order they are named", func() {
+			img, err := image.Fetch(client, pushed.Manifest.Digest, registry.Platform{})
+			Expect(err).ToNot(HaveOccurred())
+
+			fields := img.MetadataFields(image.LabelSelector{Names: []string{
+				"org.opencontainers.image.source",
+				"org.opencontainers.image.revision",
+				"some-missing-label",
+			}})
+			Expect(fields).To(Equal(append([]image.MetadataField{
+				{Name: "org.opencontainers.image.source", Value: "https://example.com/some/repo"},
+				{Name: "org.opencontainers.image.revision", Value: "some-revision"},
+			}, facts...)))
+		})
+
+		It("describes all labels sorted by name", func() {
+			img, err := image.Fetch(client, pushed.Manifest.Digest, registry.Platform{})
+			Expect(err).ToNot(HaveOccurred())
+
+			fields := img.MetadataFields(image.LabelSelector{All: true})
+			Expect(fields).To(Equal(append([]image.MetadataField{
+				{Name: "org.opencontainers.image.revision", Value: "some-revision"},
+				{Name: "org.opencontainers.image.source", Value: "https://example.com/some/repo"},
+			}, facts...)))
+		})
+
+		Context("when the config does not record when it was created", func() {
+			BeforeEach(func() {
+				config.Created = nil
+			})
+
+			It("leaves it out", func() {
+				img, err := image.Fetch(client, pushed.Manifest.Digest, registry.Platform{})
+				Expect(err).ToNot(HaveOccurred())
+
+				fields := img.MetadataFields(image.LabelSelector{})
+				Expect(fields).To(Equal([]image.MetadataField{facts[0], facts[1], facts[3]}))
+			})
+		})
+	})
+
+	Describe("Metadata", func() {
+		var img *image.Image
+
+		JustBeforeEach(func() {
+			var err error
+			img, err = image.Fetch(client, pushed.Manifest.Digest, registry.Platform{})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(img.DownloadLayers(client, layersDir)).To(Succeed())
+		})
+
+		It("leaves HOSTNAME out of the environment", func() {
+			metadata, err := img.Metadata()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(metadata.Env).To(Equal([]string{"PATH=/usr/bin:/bin", "FOO=bar"}))
+		})
+
+		It("looks up root when no user is set", func() {
+			metadata, err := img.Metadata()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(metadata.User).To(Equal("root"))
+		})
+
+		Context("when the user is named", func() {
+			BeforeEach(func() {
+				config.Config.User = "some-name:some-group"
+			})
+
+			It("uses the name as is", func() {
+				metadata, err := img.Metadata()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(metadata.User).To(Equal("some-name"))
+			})
+		})
+
+		Context("when the user is numeric", func() {
+			BeforeEach(func() {
+				config.Config.User = "1000:1000"
+			})
+
+			It("looks it up in /etc/passwd", func() {
+				metadata, err := img.Metadata()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(metadata.User).To(Equal("some-user"))
+			})
+
+			Context("when an upper layer replaces /etc/passwd", func() {
+				BeforeEach(func() {
+					layers = append(layers, registrytest.GzipLayer(
+						registrytest.RegularFile("etc/passwd", "other-user:x:1000:1000::/home/other-user:/bin/sh\n"),
+					))
+				})
+
+				It("uses the upper layer's", func() {
+					metadata, err := img.Metadata()
+					Expect(err).ToNot(HaveOccurred())
+					Expect(metadata.User).To(Equal("other-user"))
+				})
+			})
+
+			Context("when an upper layer removes /etc/passwd", func() {
+				BeforeEach(func() {
+					layers = append(layers, registrytest.GzipLayer(
+						registrytest.File{Header: tar.Header{Name: "etc/.wh.passwd", Typeflag: tar.TypeReg}},
+					))
+				})
+
+				It("leaves the user out", func() {
+					metadata, err := img.Metadata()
+					Expect(err).ToNot(HaveOccurred())
+					Expect(metadata.User).To(BeEmpty())
+				})
+			})
+
+			Context("when an upper layer makes /etc opaque", func() {
+				BeforeEach(func() {
+					layers = append(layers, registrytest.GzipLayer(
+						registrytest.Dir("etc/"),
+						registrytest.File{Header: tar.Header{Name: "etc/.wh..wh..opq", Typeflag: tar.TypeReg}},
+					))
+				})
+
+				It("leaves the user out", func() {
+					metadata, err := img.Metadata()
+					Expect(err).ToNot(HaveOccurred())
+					Expect(metadata.User).To(BeEmpty())
+				})
+			})
+
+			Context("when the user is not in /etc/passwd", func() {
+				BeforeEach(func() {
+					config.Config.User = "1001"
+				})
+
+				It("leaves the user out", func() {
+					metadata, err := img.Metadata()
+					Expect(err).ToNot(HaveOccurred())
+					Expect(metadata.User).To(BeEmpty())
+				})
+			})
+		})
+	})
+
+	Describe("WriteLayout", func() {
+		var img *image.Image
+
+		JustBeforeEach(func() {
+			var err error
+			img, err = image.Fetch(client, pushed.Manifest.Digest, registry.Platform{})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(img.DownloadLayers(client, layersDir)).To(Succeed())
+		})
+
+		checkLayout := func(files map[string][]byte) {
+			Expect(files[ocispec.ImageLayoutFile]).To(MatchJSON(`{"imageLayoutVersion":"1.0.0"}`))
+
+			var index ocispec.Index
+			Expect(json.Unmarshal(files[ocispec.ImageIndexFile], &index)).To(Succeed())
+			Expect(index.Manifests).To(HaveLen(1))
+			Expect(index.Manifests[0].Digest).To(Equal(pushed.Manifest.Digest))
+			Expect(index.Manifests[0].Size).To(Equal(pushed.Manifest.Size))
+			Expect(index.Manifests[0].MediaType).To(Equal(ocispec.MediaTypeImageManifest))
+			Expect(index.Manifests[0].Annotations).To(Equal(map[string]string{ocispec.AnnotationRefName: "some-tag"}))
+			Expect(index.Manifests[0].Platform.Architecture).To(Equal(runtime.GOARCH))
+
+			descriptors := append([]ocispec.Descriptor{pushed.Manifest, pushed.Config}, pushed.Layers...)
+			for _, descriptor := range descriptors {
+				blob := files["blobs/sha256/"+descriptor.Digest.Encoded()]
+				Expect(digest.FromBytes(blob)).To(Equal(descriptor.Digest))
+			}
+
+			Expect(files["blobs/sha256/"+pushed.Layers[0].Digest.Encoded()]).To(Equal(layers[0].Blob))
+		}
+
+		It("writes an OCI image layout with the blobs as fetched", func() {
+			dir := GinkgoT().TempDir()
+			Expect(img.WriteLayout(dir, "some-tag")).To(Succeed())
+
+			files := map[string][]byte{}
+			err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+				if err != nil || entry.IsDir() {
+					return err
+				}
+
+				name, err := filepath.Rel(dir, path)
+				if err != nil {
+					return err
+				}
+
+				files[filepath.ToSlash(name)], err = os.ReadFile(path)
+				return err
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(files).To(HaveLen(2 + 2 + len(pushed.Layers)))
+
+			checkLayout(files)
+		})
+
+		It("leaves layers downloaded into the layout where they are", func() {
+			dir := GinkgoT().TempDir()
+			Expect(img.DownloadLayers(client, filepath.Join(dir, "blobs"))).To(Succeed())
+
+			blobPath := filepath.Join(dir, "blobs", "sha256", pushed.Layers[0].Digest.Encoded())
+			downloaded, err := os.Stat(blobPath)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(img.WriteLayout(dir, "some-tag")).To(Succeed())
+
+			written, err := os.Stat(blobPath)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(os.SameFile(downloaded, written)).To(BeTrue())
+		})
+
+		It("writes an OCI image layout as a tar", func() {
+			buf := new(bytes.Buffer)
+			Expect(img.WriteLayoutTar(buf, "some-tag")).To(Succeed())
+
+			files := map[string][]byte{}
+			tr := tar.NewReader(buf)
+			for {
+				header, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				Expect(err).ToNot(HaveOccurred())
+
+				files[header.Name], err = io.ReadAll(tr)
+				Expect(err).ToNot(HaveOccurred())
+			}
+
+			checkLayout(files)
+		})
+
+		Context("when the image was fetched by the digest of an index", func() {
+			var index ocispec.Descriptor
+
+			JustBeforeEach(func() {
+				index = fakeRegistry.PushIndex("some/image", "latest", pushed.Manifest)
+
+				var err error
+				img, err = image.Fetch(client, index.Digest, registry.Platform{OS: "linux", Architecture: runtime.GOARCH})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(img.DownloadLayers(client, layersDir)).To(Succeed())
+			})
+
+			It("refers to the index, so that the layout's digest is the one fetched", func() {
+				buf := new(bytes.Buffer)
+				Expect(img.WriteLayoutTar(buf, "some-tag")).To(Succeed())
+
+				files := map[string][]byte{}
+				tr := tar.NewReader(buf)
+				for {
+					header, err := tr.Next()
+					if err == io.EOF {
+						break
+					}
+					Expect(err).ToNot(HaveOccurred())
+
+					files[header.Name], err = io.ReadAll(tr)
+					Expect(err).ToNot(HaveOccurred())
+				}
+
+				var layoutIndex ocispec.Index
+				Expect(json.Unmarshal(files[ocispec.ImageIndexFile], &layoutIndex)).To(Succeed())
+				Expect(layoutIndex.Manifests).To(HaveLen(1))
+				Expect(layoutIndex.Manifests[0].Digest).To(Equal(index.Digest))
+				Expect(layoutIndex.Manifests[0].MediaType).To(Equal(ocispec.MediaTypeImageIndex))
+				Expect(layoutIndex.Manifests[0].Annotations).To(Equal(map[string]string{ocispec.AnnotationRefName: "some-tag"}))
+
+				Expect(digest.FromBytes(files["blobs/sha256/"+index.Digest.Encoded()])).To(Equal(index.Digest))
+				Expect(digest.FromBytes(files["blobs/sha256/"+pushed.Manifest.Digest.Encoded()])).To(Equal(pushed.Manifest.Digest))
+			})
+		})
+
+		Context("when the index was looked up by tag", func() {
+			It("refers to the manifest fetched", func() {
+				fakeRegistry.PushIndex("some/image", "latest", pushed.Manifest)
+				Expect(img.FindIndex(client, "latest")).To(Succeed())
+				Expect(img.Index).ToNot(BeNil())
+
+				dir := GinkgoT().TempDir()
+				Expect(img.WriteLayout(dir, "some-tag")).To(Succeed())
+
+				content, err := os.ReadFile(filepath.Join(dir, ocispec.ImageIndexFile))
+				Expect(err).ToNot(HaveOccurred())
+
+				var layoutIndex ocispec.Index
+				Expect(json.Unmarshal(content, &layoutIndex)).To(Succeed())
+				Expect(layoutIndex.Manifests[0].Digest).To(Equal(pushed.Manifest.Digest))
+			})
+		})
+	})
+})
+
+var _ = DescribeTable("LabelSelector",
+	func(config string, expected image.LabelSelector, errMessage string) {
+		var selector image.LabelSelector
+		err := json.Unmarshal([]byte(config), &selector)
+		if errMessage != "" {
+			Expect(err).To(MatchError(errMessage))
+			return
+		}
+
+		Expect(err).ToNot(HaveOccurred())
+		Expect(selector).To(Equal(expected))
+	},
+	Entry("a list of names", `["some-label","other-label"]`, image.LabelSelector{Names: []string{"some-label", "other-label"}}, ""),
+	Entry("all", `"all"`, image.LabelSelector{All: true}, ""),
+	Entry("another string", `"some-label"`, image.LabelSelector{}, `must be a list of label names or "all"`),
+	Entry("an object", `{}`, image.LabelSelector{}, `must be a list of label names or "all"`),
+)
@@ -0,0 +1,203 @@
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/concourse/docker-image-resource/cmd/print-metadata/passwd"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Inspect is what `docker inspect` prints about an image, as far as it can be
+// told from the image itself.
+type Inspect struct {
+	ID           string              `json:"Id"`
+	RepoTags     []string            `json:"RepoTags"`
+	RepoDigests  []string            `json:"RepoDigests"`
+	Created      *time.Time          `json:"Created,omitempty"`
+	Author       string              `json:"Author"`
+	Config       ocispec.ImageConfig `json:"Config"`
+	Architecture string              `json:"Architecture"`
+	Variant      string              `json:"Variant,omitempty"`
+	Os           string              `json:"Os"`
+	Size         int64               `json:"Size"`
+	RootFS       InspectRootFS       `json:"RootFS"`
+}
+
+type InspectRootFS struct {
+	Type   string          `json:"Type"`
+	Layers []digest.Digest `json:"Layers"`
+}
+
+// Digest returns the digest the image was fetched by, i.e. that of its
+// index if it is multi-arch.
+func (image *Image) Digest() digest.Digest {
+	if image.Index != nil {
+		return image.Index.Digest
+	}
+
+	return image.Manifest.Digest
+}
+
+// Inspect describes the image as if it had been pulled as repository:tag.
+// Its size is that of its uncompressed layers, once downloaded.
+func (image *Image) Inspect(repository string, tag string) Inspect {
+	inspect := Inspect{
+		ID:           string(image.ID()),
+		RepoTags:     []string{repository + ":" + tag},
+		RepoDigests:  []string{repository + "@" + string(image.Digest())},
+		Created:      image.config.Created,
+		Author:       image.config.Author,
+		Config:       image.config.Config,
+		Architecture: image.config.Architecture,
+		Variant:      image.config.Variant,
+		Os:           image.config.OS,
+		RootFS: InspectRootFS{
+			Type:   image.config.RootFS.Type,
+			Layers: image.config.RootFS.DiffIDs,
+		},
+	}
+
+	for _, layer := range image.Layers {
+		inspect.Size += layer.UncompressedSize
+	}
+
+	return inspect
+}
+
+// Metadata is what assets/in writes to metadata.json, i.e. what
+// print-metadata reports when run in a container of the image.
+type Metadata struct {
+	User string   `json:"user,omitempty"`
+	Env  []string `json:"env"`
+}
+
+var blacklistedEnv = map[string]bool{
+	"HOSTNAME": true,
+}
+
+// Metadata returns the image's user and environment. Numeric (or unset)
+// users are looked up in the /etc/passwd of the downloaded layers, and left
+// out if they are not found there.
+func (image *Image) Metadata() (Metadata, error) {
+	metadata := Metadata{}
+
+	for _, e := range image.config.Config.Env {
+		name, _, _ := strings.Cut(e, "=")
+		if !blacklistedEnv[name] {
+			metadata.Env = append(metadata.Env, e)
+		}
+	}
+
+	user, _, _ := strings.Cut(image.config.Config.User, ":")
+	if user == "" {
+		user = "0"
+	}
+
+	uid, err := strconv.Atoi(user)
+	if err != nil {
+		metadata.User = user
+		return metadata, nil
+	}
+
+	etcPasswd, found, err := image.ReadFile("/etc/passwd")
+	if err != nil || !found {
+		return metadata, err
+	}
+
+	users, err := passwd.ParseUsers(bytes.NewReader(etcPasswd))
+	if err != nil {
+		// print-metadata leaves the user out as well
+		return metadata, nil
+	}
+
+	metadata.User, _ = users.NameForID(uid)
+
+	return metadata, nil
+}
+
+// errWhitedOut stops the search for a file removed by an upper layer.
+var errWhitedOut = errors.New("whited out")
+
+// ReadFile returns the content of a regular file of the image's filesystem,
+// as seen through its downloaded layers.
+func (image *Image) ReadFile(name string) ([]byte, bool, error) {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+
+	for i := len(image.Layers) - 1; i >= 0; i-- {
+		content, found, err := image.Layers[i].readFile(name)
+		if errors.Is(err, errWhitedOut) {
+			return nil, false, nil
+		}
+		if err != nil || found {
+			return content, found, err
+		}
+	}
+
+	return nil, false, nil
+}
+
+// readFile looks for a regular file in the layer, failing with errWhitedOut
+// if the layer removes it or any of its parent directories.
+func (layer Layer) readFile(name string) ([]byte, bool, error) {
+	content, err := layer.Open()
+	if err != nil {
+		return nil, false, err
+	}
+	defer content.Close()
+
+	var whitedOut bool
+
+	tr := tar.NewReader(content)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, false, err
+		}
+
+		entry := strings.TrimPrefix(path.Clean("/"+header.Name), "/")
+		if entry == name {
+			if header.Typeflag != tar.TypeReg {
+				return nil, false, nil
+			}
+
+			file, err := io.ReadAll(tr)
+			return file, err == nil, err
+		}
+
+		dir, base := path.Split(entry)
+		dir = strings.TrimSuffix(dir, "/")
+
+		if base == opaqueWhiteout {
+			whitedOut = whitedOut || isParent(dir, name)
+		} else if removed, found := strings.CutPrefix(base, whiteoutPrefix); found {
+			whitedOut = whitedOut || isParent(path.Join(dir, removed), name)
+		}
+	}
+
+	if whitedOut {
+		return nil, false, errWhitedOut
+	}
+
+	return nil, false, nil
+}
+
+const (
+	whiteoutPrefix = ".wh."
+	opaqueWhiteout = ".wh..wh..opq"
+)
+
+// isParent reports whether a path is or contains another.
+func isParent(dir string, name string) bool {
+	return dir == "" || dir == name || strings.HasPrefix(name, dir+"/")
+}
@@ -0,0 +1,93 @@
+package image
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/concourse/docker-image-resource/registry"
+)
+
+// MetadataField is an entry of the metadata Concourse shows for a version.
+type MetadataField struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// LabelSelector selects labels of the image config, either by name or, when
+// configured as "all", every one of them.
+type LabelSelector struct {
+	All   bool
+	Names []string
+}
+
+// UnmarshalJSON accepts a list of label names or the string "all".
+func (selector *LabelSelector) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		if s != "all" {
+			return errors.New(`must be a list of label names or "all"`)
+		}
+
+		*selector = LabelSelector{All: true}
+		return nil
+	}
+
+	var names []string
+	if err := json.Unmarshal(b, &names); err != nil {
+		return errors.New(`must be a list of label names or "all"`)
+	}
+
+	*selector = LabelSelector{Names: names}
+	return nil
+}
+
+// MetadataFields describes the image as read from its manifest and config:
+// the selected labels, in the order they were named or sorted by name when
+// all of them are selected, followed by the image's compressed size, its
+// number of layers, when it was created and its platform. Labels the image
+// does not have are left out, as are fields the config does not record.
+func (image *Image) MetadataFields(labels LabelSelector) []MetadataField {
+	names := labels.Names
+	if labels.All {
+		names = nil
+		for name := range image.config.Config.Labels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+
+	fields := []MetadataField{}
+	for _, name := range names {
+		if value, found := image.config.Config.Labels[name]; found {
+			fields = append(fields, MetadataField{Name: name, Value: value})
+		}
+	}
+
+	var size int64
+	for _, layer := range image.manifest.Layers {
+		size += layer.Size
+	}
+
+	fields = append(fields,
+		MetadataField{Name: "size", Value: strconv.FormatInt(size, 10)},
+		MetadataField{Name: "layers", Value: strconv.Itoa(len(image.manifest.Layers))},
+	)
+
+	if image.config.Created != nil {
+		fields = append(fields, MetadataField{Name: "created", Value: image.config.Created.UTC().Format(time.RFC3339)})
+	}
+
+	platform := registry.Platform{
+		OS:           image.config.OS,
+		Architecture: image.config.Architecture,
+		Variant:      image.config.Variant,
+	}
+	if platform.OS != "" && platform.Architecture != "" {
+		fields = append(fields, MetadataField{Name: "platform", Value: platform.String()})
+	}
+
+	return fields
+}
@@ -0,0 +1,240 @@
+package image
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/concourse/docker-image-resource/registry"
+	"github.com/klauspost/compress/zstd"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Layer is a layer of an image downloaded to disk, exactly as it was fetched.
+type Layer struct {
+	ocispec.Descriptor
+
+	// DiffID is the digest of the layer's uncompressed content.
+	DiffID digest.Digest
+	// UncompressedSize is the size of the layer's uncompressed content.
+	UncompressedSize int64
+	// Path is where the layer blob was downloaded to.
+	Path string
+}
+
+// Open opens the layer's uncompressed content, which is a tar archive.
+func (layer Layer) Open() (io.ReadCloser, error) {
+	file, err := os.Open(layer.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := Decompress(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &layerReader{ReadCloser: content, file: file}, nil
+}
+
+type layerReader struct {
+	io.ReadCloser
+	file *os.File
+}
+
+func (reader *layerReader) Close() error {
+	reader.ReadCloser.Close()
+	return reader.file.Close()
+}
+
+// LayerInfo describes a layer as the registry serves it, along with the
+// history entry of the config which created it. Its uncompressed size is
+// only known once it has been downloaded.
+type LayerInfo struct {
+	Digest           digest.Digest    `json:"digest"`
+	MediaType        string           `json:"media_type"`
+	Size             int64            `json:"size"`
+	UncompressedSize int64            `json:"uncompressed_size,omitempty"`
+	DiffID           digest.Digest    `json:"diff_id"`
+	History          *ocispec.History `json:"history,omitempty"`
+}
+
+// LayerInfo describes the image's layers, as listed by its manifest and
+// config. History entries are matched to layers in order, skipping those
+// marked as empty layers; a layer is left without history if the config
+// does not record one for each layer.
+func (image *Image) LayerInfo() []LayerInfo {
+	var history []ocispec.History
+	for _, entry := range image.config.History {
+		if !entry.EmptyLayer {
+			history = append(history, entry)
+		}
+	}
+
+	if len(history) != len(image.manifest.Layers) {
+		history = nil
+	}
+
+	downloaded := len(image.Layers) == len(image.manifest.Layers)
+
+	infos := []LayerInfo{}
+	for i, descriptor := range image.manifest.Layers {
+		info := LayerInfo{
+			Digest:    descriptor.Digest,
+			MediaType: descriptor.MediaType,
+			Size:      descriptor.Size,
+			DiffID:    image.config.RootFS.DiffIDs[i],
+		}
+
+		if downloaded {
+			info.UncompressedSize = image.Layers[i].UncompressedSize
+		}
+
+		if history != nil {
+			info.History = &history[i]
+		}
+
+		infos = append(infos, info)
+	}
+
+	return infos
+}
+
+// DownloadLayers downloads the image's layers into a directory, each to
+// <algorithm>/<encoded digest> as in an OCI image layout's blobs directory.
+// Each layer is verified against its digest and size, and its uncompressed
+// content against the diff ID listed in the config.
+func (image *Image) DownloadLayers(client *registry.Client, dir string) error {
+	image.Layers = nil
+
+	for i, descriptor := range image.manifest.Layers {
+		layer := Layer{
+			Descriptor: descriptor,
+			DiffID:     image.config.RootFS.DiffIDs[i],
+		}
+
+		if err := descriptor.Digest.Validate(); err != nil {
+			return fmt.Errorf("invalid layer digest '%s': %w", descriptor.Digest, err)
+		}
+
+		layer.Path = filepath.Join(dir, descriptor.Digest.Algorithm().String(), descriptor.Digest.Encoded())
+
+		if err := downloadBlob(client, descriptor, layer.Path); err != nil {
+			return fmt.Errorf("failed to download layer %s: %w", descriptor.Digest, err)
+		}
+
+		if err := layer.verifyDiffID(); err != nil {
+			return fmt.Errorf("failed to verify layer %s: %w", descriptor.Digest, err)
+		}
+
+		image.Layers = append(image.Layers, layer)
+	}
+
+	return nil
+}
+
+// downloadBlob downloads a blob to a file, verifying it against its
+// descriptor.
+func downloadBlob(client *registry.Client, descriptor ocispec.Descriptor, path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	blob, err := client.GetBlob(descriptor.Digest)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	verifier := descriptor.Digest.Verifier()
+
+	written, err := io.Copy(io.MultiWriter(file, verifier), io.LimitReader(blob, descriptor.Size+1))
+	if err != nil {
+		return err
+	}
+
+	if written != descriptor.Size {
+		return &SizeError{Digest: descriptor.Digest, Expected: descriptor.Size}
+	}
+
+	if !verifier.Verified() {
+		actual, err := descriptor.Digest.Algorithm().FromReader(io.NewSectionReader(file, 0, written))
+		if err != nil {
+			return err
+		}
+
+		return &DigestError{Expected: descriptor.Digest, Actual: actual}
+	}
+
+	return file.Close()
+}
+
+// verifyDiffID decompresses the layer to verify it against its diff ID and
+// to measure its uncompressed size.
+func (layer *Layer) verifyDiffID() error {
+	if err := layer.DiffID.Validate(); err != nil {
+		return fmt.Errorf("invalid diff ID '%s': %w", layer.DiffID, err)
+	}
+
+	content, err := layer.Open()
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	digester := layer.DiffID.Algorithm().Digester()
+
+	layer.UncompressedSize, err = io.Copy(digester.Hash(), content)
+	if err != nil {
+		return fmt.Errorf("failed to decompress: %w", err)
+	}
+
+	if actual := digester.Digest(); actual != layer.DiffID {
+		return &DigestError{Expected: layer.DiffID, Actual: actual}
+	}
+
+	return nil
+}
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// Decompress returns the uncompressed content of a layer, which may be
+// gzip or zstd compressed or not at all. The compression is detected from
+// the content rather than the media type, which registries do not always get
+// right.
+func Decompress(blob io.Reader) (io.ReadCloser, error) {
+	buffered := bufio.NewReader(blob)
+
+	magic, err := buffered.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return gzip.NewReader(buffered)
+	case bytes.HasPrefix(magic, zstdMagic):
+		decoder, err := zstd.NewReader(buffered)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	default:
+		return io.NopCloser(buffered), nil
+	}
+}
@@ -0,0 +1,231 @@
+package image
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// layoutBlob is a blob of an OCI image layout, either in memory or in a file.
+type layoutBlob struct {
+	digest  digest.Digest
+	content []byte
+	path    string
+	size    int64
+}
+
+func (blob layoutBlob) name() string {
+	return path.Join(ocispec.ImageBlobsDir, blob.digest.Algorithm().String(), blob.digest.Encoded())
+}
+
+// layout returns the files of an OCI image layout holding the image under
+// the given tag: its index, its oci-layout file, and its blobs, which are
+// written exactly as they were fetched. The layout's index refers to what
+// the image was fetched by, i.e. to the image's own index if it was fetched
+// by the digest of one, so that the digests match.
+func (image *Image) layout(tag string) ([]byte, []byte, []layoutBlob, error) {
+	top := ocispec.Descriptor{
+		MediaType: image.Manifest.MediaType,
+		Digest:    image.Manifest.Digest,
+		Size:      int64(len(image.Manifest.Body)),
+		Platform: &ocispec.Platform{
+			OS:           image.config.OS,
+			Architecture: image.config.Architecture,
+			Variant:      image.config.Variant,
+		},
+	}
+
+	blobs := []layoutBlob{
+		{digest: image.Manifest.Digest, content: image.Manifest.Body, size: int64(len(image.Manifest.Body))},
+		{digest: image.ID(), content: image.Config, size: int64(len(image.Config))},
+	}
+
+	if image.Index != nil && image.Index.Digest == image.ref {
+		top = ocispec.Descriptor{
+			MediaType: image.Index.MediaType,
+			Digest:    image.Index.Digest,
+			Size:      int64(len(image.Index.Body)),
+		}
+
+		blobs = append([]layoutBlob{
+			{digest: image.Index.Digest, content: image.Index.Body, size: int64(len(image.Index.Body))},
+		}, blobs...)
+	}
+
+	if tag != "" {
+		top.Annotations = map[string]string{ocispec.AnnotationRefName: tag}
+	}
+
+	index := ocispec.Index{
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []ocispec.Descriptor{top},
+	}
+	index.SchemaVersion = 2
+
+	indexJSON, err := json.Marshal(index)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	layoutJSON, err := json.Marshal(ocispec.ImageLayout{Version: ocispec.ImageLayoutVersion})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	for _, layer := range image.Layers {
+		blobs = append(blobs, layoutBlob{digest: layer.Digest, path: layer.Path, size: layer.Size})
+	}
+
+	return indexJSON, layoutJSON, blobs, nil
+}
+
+// WriteLayout writes the image as an OCI image layout into a directory.
+// Layers downloaded into the layout's blobs directory are left where they
+// are; others are copied there.
+func (image *Image) WriteLayout(dir string, tag string) error {
+	indexJSON, layoutJSON, blobs, err := image.layout(tag)
+	if err != nil {
+		return err
+	}
+
+	for _, blob := range blobs {
+		if err := writeLayoutBlob(dir, blob); err != nil {
+			return err
+		}
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, ocispec.ImageLayoutFile), layoutJSON, 0644); err != nil {
+		return err
+	}
+
+	// written last, as it is what makes the layout usable
+	return os.WriteFile(filepath.Join(dir, ocispec.ImageIndexFile), indexJSON, 0644)
+}
+
+func writeLayoutBlob(dir string, blob layoutBlob) error {
+	target := filepath.Join(dir, filepath.FromSlash(blob.name()))
+
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+
+	if blob.path == "" {
+		return os.WriteFile(target, blob.content, 0644)
+	}
+
+	if sameFile(blob.path, target) {
+		return nil
+	}
+
+	source, err := os.Open(blob.path)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	file, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(file, source); err != nil {
+		return err
+	}
+
+	return file.Close()
+}
+
+func sameFile(a string, b string) bool {
+	aInfo, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+
+	bInfo, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+
+	return os.SameFile(aInfo, bInfo)
+}
+
+// WriteLayoutTar writes the image as an OCI image layout archived in a
+// single tar, as read by e.g. skopeo's oci-archive transport.
+func (image *Image) WriteLayoutTar(w io.Writer, tag string) error {
+	indexJSON, layoutJSON, blobs, err := image.layout(tag)
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+
+	if err := writeTarFile(tw, ocispec.ImageLayoutFile, layoutJSON); err != nil {
+		return err
+	}
+
+	if err := writeTarFile(tw, ocispec.ImageIndexFile, indexJSON); err != nil {
+		return err
+	}
+
+	written := map[digest.Digest]bool{}
+	for _, blob := range blobs {
+		// layers may be repeated in an image
+		if written[blob.digest] {
+			continue
+		}
+		written[blob.digest] = true
+
+		if err := writeTarBlob(tw, blob); err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
+
+func writeTarFile(tw *tar.Writer, name string, content []byte) error {
+	err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0644,
+		Size:     int64(len(content)),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = tw.Write(content)
+	return err
+}
+
+func writeTarBlob(tw *tar.Writer, blob layoutBlob) error {
+	if blob.path == "" {
+		return writeTarFile(tw, blob.name(), blob.content)
+	}
+
+	file, err := os.Open(blob.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	err = tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     blob.name(),
+		Mode:     0644,
+		Size:     blob.size,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tw, file)
+	return err
+}
@@ -0,0 +1,115 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const (
+	azureDefaultAuthorityHost = "https://login.microsoftonline.com"
+	acrScope                  = "https://containerregistry.azure.net/.default"
+
+	// acrUsername is the username ACR expects alongside a refresh token.
+	acrUsername = "00000000-0000-0000-0000-000000000000"
+)
+
+// AzureConfig identifies a service principal, authenticating either with a
+// client secret or with a federated token such as one projected by Azure
+// workload identity, whose Microsoft Entra ID token is exchanged for an ACR
+// refresh token.
+type AzureConfig struct {
+	TenantID           string `json:"tenant_id"`
+	ClientID           string `json:"client_id"`
+	ClientSecret       string `json:"client_secret"`
+	FederatedTokenFile string `json:"federated_token_file"`
+
+	AuthorityHost string `json:"authority_host"`
+	ExchangeURL   string `json:"exchange_url"`
+}
+
+// azureCredentials gets a Microsoft Entra ID access token for the service
+// principal and exchanges it for an ACR refresh token. The refresh token is
+// both sent as a password and used as an identity token, which ACR accepts
+// alike.
+func azureCredentials(client *http.Client, azure AzureConfig, registryHost string) (Credentials, error) {
+	accessToken, err := azure.accessToken(client)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("failed to get Azure access token: %w", err)
+	}
+
+	exchangeURL := azure.ExchangeURL
+	if exchangeURL == "" {
+		exchangeURL = "https://" + registryHost + "/oauth2/exchange"
+	}
+
+	var response struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	err = postTokenForm(client, exchangeURL, url.Values{
+		"grant_type":   {"access_token"},
+		"service":      {registryHost},
+		"tenant":       {azure.TenantID},
+		"access_token": {accessToken},
+	}, &response)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("failed to exchange Azure access token for an ACR refresh token: %w", err)
+	}
+
+	return Credentials{
+		Username:      acrUsername,
+		Password:      response.RefreshToken,
+		IdentityToken: response.RefreshToken,
+	}, nil
+}
+
+// accessToken requests an access token for ACR with a client credentials
+// grant.
+func (azure AzureConfig) accessToken(client *http.Client) (string, error) {
+	if azure.TenantID == "" || azure.ClientID == "" {
+		return "", errors.New("azure requires tenant_id and client_id")
+	}
+
+	form := url.Values{
+		"grant_type": {"client_credentials"},
+		"client_id":  {azure.ClientID},
+		"scope":      {acrScope},
+	}
+
+	switch {
+	case azure.ClientSecret != "":
+		form.Set("client_secret", azure.ClientSecret)
+
+	case azure.FederatedTokenFile != "":
+		token, err := os.ReadFile(azure.FederatedTokenFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read federated token: %w", err)
+		}
+
+		form.Set("client_assertion_type", "urn:ietf:params:oauth:client-assertion-type:jwt-bearer")
+		form.Set("client_assertion", strings.TrimSpace(string(token)))
+
+	default:
+		return "", errors.New("azure requires client_secret or federated_token_file")
+	}
+
+	authorityHost := azure.AuthorityHost
+	if authorityHost == "" {
+		authorityHost = azureDefaultAuthorityHost
+	}
+
+	var response struct {
+		AccessToken string `json:"access_token"`
+	}
+
+	err := postTokenForm(client, strings.TrimSuffix(authorityHost, "/")+"/"+azure.TenantID+"/oauth2/v2.0/token", form, &response)
+	if err != nil {
+		return "", err
+	}
+
+	return response.AccessToken, nil
+}
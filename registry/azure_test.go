@@ -0,0 +1,125 @@
+package registry_test
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/lager/v3/lagertest"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+
+	"github.com/concourse/docker-image-resource/registry"
+)
+
+var _ = Describe("Azure", func() {
+	var (
+		server *ghttp.Server
+		config registry.Config
+
+		clientAuth func(*http.Request)
+	)
+
+	BeforeEach(func() {
+		server = ghttp.NewServer()
+
+		clientAuth = func(r *http.Request) {
+			Expect(r.PostForm.Get("client_secret")).To(Equal("some-secret"))
+		}
+
+		server.RouteToHandler("POST", "/some-tenant/oauth2/v2.0/token", ghttp.CombineHandlers(
+			func(w http.ResponseWriter, r *http.Request) {
+				Expect(r.ParseForm()).To(Succeed())
+				Expect(r.PostForm.Get("grant_type")).To(Equal("client_credentials"))
+				Expect(r.PostForm.Get("client_id")).To(Equal("some-client"))
+				Expect(r.PostForm.Get("scope")).To(Equal("https://containerregistry.azure.net/.default"))
+				clientAuth(r)
+			},
+			ghttp.RespondWith(http.StatusOK, `{"token_type":"Bearer","access_token":"some-entra-token"}`),
+		))
+		server.RouteToHandler("POST", "/oauth2/exchange", ghttp.CombineHandlers(
+			func(w http.ResponseWriter, r *http.Request) {
+				Expect(r.ParseForm()).To(Succeed())
+				Expect(r.PostForm.Get("grant_type")).To(Equal("access_token"))
+				Expect(r.PostForm.Get("service")).To(Equal(server.Addr()))
+				Expect(r.PostForm.Get("tenant")).To(Equal("some-tenant"))
+				Expect(r.PostForm.Get("access_token")).To(Equal("some-entra-token"))
+			},
+			ghttp.RespondWith(http.StatusOK, `{"refresh_token":"some-acr-refresh-token"}`),
+		))
+
+		config = registry.Config{
+			Repository: server.Addr() + "/some/image",
+			Azure: &registry.AzureConfig{
+				TenantID:      "some-tenant",
+				ClientID:      "some-client",
+				ClientSecret:  "some-secret",
+				AuthorityHost: server.URL(),
+				ExchangeURL:   server.URL() + "/oauth2/exchange",
+			},
+		}
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("exchanges the refresh token for access tokens to the repository", func() {
+		server.RouteToHandler("GET", "/v2/", ghttp.RespondWith(http.StatusUnauthorized, "", http.Header{
+			"WWW-Authenticate": {`Bearer realm="` + server.URL() + `/oauth2/token",service="` + server.Addr() + `"`},
+		}))
+		server.RouteToHandler("POST", "/oauth2/token", ghttp.CombineHandlers(
+			func(w http.ResponseWriter, r *http.Request) {
+				Expect(r.ParseForm()).To(Succeed())
+				Expect(r.PostForm.Get("grant_type")).To(Equal("refresh_token"))
+				Expect(r.PostForm.Get("refresh_token")).To(Equal("some-acr-refresh-token"))
+				Expect(r.PostForm.Get("scope")).To(Equal("repository:some/image:pull"))
+			},
+			ghttp.RespondWith(http.StatusOK, `{"access_token":"some-access-token"}`),
+		))
+		server.RouteToHandler("HEAD", "/v2/some/image/manifests/latest", ghttp.CombineHandlers(
+			ghttp.VerifyHeaderKV("Authorization", "Bearer some-access-token"),
+			ghttp.RespondWith(http.StatusOK, "", http.Header{
+				"Docker-Content-Digest": {"sha256:c4c25c2cd70e3071f08cf124c4b5c656c061dd38247d166d97098d58eeea8aa6"},
+			}),
+		))
+
+		client, err := registry.NewClient(lagertest.NewTestLogger("registry"), config)
+		Expect(err).ToNot(HaveOccurred())
+
+		_, err = client.ResolveDigest("latest")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("returns the refresh token to log in with", func() {
+		username, password, err := registry.LoginCredentials(config)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(username).To(Equal("00000000-0000-0000-0000-000000000000"))
+		Expect(password).To(Equal("some-acr-refresh-token"))
+	})
+
+	It("authenticates with a federated token", func() {
+		tokenFile := filepath.Join(GinkgoT().TempDir(), "token")
+		Expect(os.WriteFile(tokenFile, []byte("some-federated-token\n"), 0600)).To(Succeed())
+
+		config.Azure.ClientSecret = ""
+		config.Azure.FederatedTokenFile = tokenFile
+
+		clientAuth = func(r *http.Request) {
+			Expect(r.PostForm.Get("client_assertion_type")).To(Equal("urn:ietf:params:oauth:client-assertion-type:jwt-bearer"))
+			Expect(r.PostForm.Get("client_assertion")).To(Equal("some-federated-token"))
+		}
+
+		_, password, err := registry.LoginCredentials(config)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(password).To(Equal("some-acr-refresh-token"))
+	})
+
+	It("requires a way to authenticate the service principal", func() {
+		config.Azure.ClientSecret = ""
+
+		_, _, err := registry.LoginCredentials(config)
+		Expect(err).To(MatchError(ContainSubstring("azure requires client_secret or federated_token_file")))
+	})
+})
@@ -0,0 +1,458 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"code.cloudfoundry.org/lager/v3"
+	"github.com/distribution/reference"
+	"github.com/docker/distribution"
+	_ "github.com/docker/distribution/manifest/schema1"
+	_ "github.com/docker/distribution/manifest/schema2"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Setting User-Agent helps avoid the Cloudflare challenge page. The
+// go-containerregistry sets this and we never get the challenge page with that
+// resource-type
+const userAgent = "concourse/docker-image-resource"
+
+// Client talks to the registry of a single repository, through its mirrors
+// if any are configured.
+type Client struct {
+	logger    lager.Logger
+	endpoints []*endpoint
+
+	lastServed *endpoint
+}
+
+// NewClient sets up the endpoints serving the configured repository, i.e.
+// its mirrors (if any) followed by its registry, and connects to the first
+// available one.
+func NewClient(logger lager.Logger, config Config) (*Client, error) {
+	if config.IsECR(config.Repository) {
+		ecrUser, ecrPass, err := ECRCredentials(config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get ECR credentials: %w", err)
+		}
+		config.Username = ecrUser
+		config.Password = ecrPass
+	}
+
+	registryHost, repo, err := ParseRepository(config.Repository)
+	if err != nil {
+		return nil, err
+	}
+
+	var endpoints []*endpoint
+	for _, mirror := range config.mirrorsFor(registryHost) {
+		endpoint, err := newMirrorEndpoint(logger, config, mirror, repo)
+		if err != nil {
+			return nil, err
+		}
+
+		endpoints = append(endpoints, endpoint)
+	}
+
+	endpoints = append(endpoints, newEndpoint(logger, config, registryHost, repo, true))
+
+	client := &Client{
+		logger:    logger,
+		endpoints: endpoints,
+	}
+
+	// fail early when no endpoint can be reached at all
+	for i, endpoint := range endpoints {
+		err = endpoint.connect()
+		if err == nil {
+			break
+		}
+
+		if i < len(endpoints)-1 {
+			client.fallBack(endpoint, err)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return client, nil
+}
+
+// Manifest is a manifest (or index) as served by the registry.
+type Manifest struct {
+	MediaType string
+	Digest    digest.Digest
+	Body      []byte
+}
+
+// IsIndex reports whether the manifest is an OCI image index or a Docker
+// manifest list.
+func (manifest Manifest) IsIndex() bool {
+	return manifest.MediaType == ocispec.MediaTypeImageIndex || manifest.MediaType == MediaTypeDockerManifestList
+}
+
+// ResolveDigest returns the digest of the manifest referenced by a tag or a
+// digest, preferring a HEAD request.
+func (client *Client) ResolveDigest(ref string) (string, error) {
+	var manifestDigest string
+	err := client.do(func(endpoint *endpoint) error {
+		var err error
+		manifestDigest, err = endpoint.resolveDigest(ref)
+		return err
+	})
+
+	return manifestDigest, err
+}
+
+// HeadManifest fetches the media type and digest of the manifest referenced
+// by a tag or a digest without fetching its body, which Docker Hub does not
+// count towards the pull rate limit. The returned manifest has no Body, and its
+// Digest is empty if the registry did not report one.
+func (client *Client) HeadManifest(ref string) (Manifest, error) {
+	var manifest Manifest
+	err := client.do(func(endpoint *endpoint) error {
+		var err error
+		manifest, err = endpoint.headManifest(ref)
+		return err
+	})
+
+	return manifest, err
+}
+
+// GetManifest fetches the manifest referenced by a tag or a digest, accepting
+// image indexes and manifest lists as well as image manifests.
+func (client *Client) GetManifest(ref string) (Manifest, error) {
+	var manifest Manifest
+	err := client.do(func(endpoint *endpoint) error {
+		var err error
+		manifest, err = endpoint.getManifest(ref)
+		return err
+	})
+
+	return manifest, err
+}
+
+// GetBlob fetches the blob with the given digest. The caller must close the
+// returned reader.
+func (client *Client) GetBlob(blobDigest digest.Digest) (io.ReadCloser, error) {
+	var blob io.ReadCloser
+	err := client.do(func(endpoint *endpoint) error {
+		var err error
+		blob, err = endpoint.getBlob(blobDigest)
+		return err
+	})
+
+	return blob, err
+}
+
+// ListTags fetches every tag of the repository, following the pagination
+// links returned by the registry.
+func (client *Client) ListTags() ([]string, error) {
+	var tags []string
+	err := client.do(func(endpoint *endpoint) error {
+		var err error
+		tags, err = endpoint.listTags()
+		return err
+	})
+
+	return tags, err
+}
+
+func (endpoint *endpoint) resolveDigest(ref string) (string, error) {
+	manifestURL, err := endpoint.manifestURL(ref)
+	if err != nil {
+		return "", err
+	}
+
+	manifestRequest, err := http.NewRequest(http.MethodHead, manifestURL, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to build manifest request: %w", err)
+	}
+	manifestRequest.Header.Add("Accept", MediaTypeDockerManifest)
+	manifestRequest.Header.Add("Accept", ocispec.MediaTypeImageIndex)
+	manifestRequest.Header.Add("Accept", "application/json")
+	manifestRequest.Header.Add("User-Agent", userAgent)
+
+	manifestResponse, err := endpoint.http.Do(manifestRequest)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch manifest: %w", err)
+	}
+
+	defer manifestResponse.Body.Close()
+
+	if manifestResponse.StatusCode != http.StatusOK {
+		return "", newStatusError(manifestResponse)
+	}
+
+	digest := manifestResponse.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		return endpoint.fetchDigest(manifestURL)
+	}
+
+	return digest, nil
+}
+
+func (endpoint *endpoint) fetchDigest(manifestURL string) (string, error) {
+	manifestRequest, err := http.NewRequest("GET", manifestURL, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to build manifest request: %w", err)
+	}
+	manifestRequest.Header.Add("Accept", MediaTypeDockerManifest)
+	manifestRequest.Header.Add("Accept", ocispec.MediaTypeImageIndex)
+	manifestRequest.Header.Add("Accept", "application/json")
+	manifestRequest.Header.Add("User-Agent", userAgent)
+
+	manifestResponse, err := endpoint.http.Do(manifestRequest)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch manifest: %w", err)
+	}
+
+	defer manifestResponse.Body.Close()
+
+	if manifestResponse.StatusCode != http.StatusOK {
+		return "", newStatusError(manifestResponse)
+	}
+
+	ctHeader := manifestResponse.Header.Get("Content-Type")
+
+	bytes, err := io.ReadAll(manifestResponse.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	_, desc, err := distribution.UnmarshalManifest(ctHeader, bytes)
+	if err != nil {
+		return "", fmt.Errorf("failed to unmarshal manifest: %w", err)
+	}
+
+	return string(desc.Digest), nil
+}
+
+func (endpoint *endpoint) headManifest(ref string) (Manifest, error) {
+	manifestURL, err := endpoint.manifestURL(ref)
+	if err != nil {
+		return Manifest{}, err
+	}
+
+	manifestRequest, err := http.NewRequest(http.MethodHead, manifestURL, nil)
+	if err != nil {
+		return Manifest{}, fmt.Errorf("failed to build manifest request: %w", err)
+	}
+	manifestRequest.Header.Add("Accept", MediaTypeDockerManifestList)
+	manifestRequest.Header.Add("Accept", ocispec.MediaTypeImageIndex)
+	manifestRequest.Header.Add("Accept", MediaTypeDockerManifest)
+	manifestRequest.Header.Add("Accept", ocispec.MediaTypeImageManifest)
+	manifestRequest.Header.Add("User-Agent", userAgent)
+
+	manifestResponse, err := endpoint.http.Do(manifestRequest)
+	if err != nil {
+		return Manifest{}, fmt.Errorf("failed to fetch manifest: %w", err)
+	}
+
+	defer manifestResponse.Body.Close()
+
+	if manifestResponse.StatusCode != http.StatusOK {
+		return Manifest{}, newStatusError(manifestResponse)
+	}
+
+	return Manifest{
+		MediaType: manifestResponse.Header.Get("Content-Type"),
+		Digest:    digest.Digest(manifestResponse.Header.Get("Docker-Content-Digest")),
+	}, nil
+}
+
+func (endpoint *endpoint) getManifest(ref string) (Manifest, error) {
+	manifestURL, err := endpoint.manifestURL(ref)
+	if err != nil {
+		return Manifest{}, err
+	}
+
+	manifestRequest, err := http.NewRequest(http.MethodGet, manifestURL, nil)
+	if err != nil {
+		return Manifest{}, fmt.Errorf("failed to build manifest request: %w", err)
+	}
+	manifestRequest.Header.Add("Accept", MediaTypeDockerManifestList)
+	manifestRequest.Header.Add("Accept", ocispec.MediaTypeImageIndex)
+	manifestRequest.Header.Add("Accept", MediaTypeDockerManifest)
+	manifestRequest.Header.Add("Accept", ocispec.MediaTypeImageManifest)
+	manifestRequest.Header.Add("User-Agent", userAgent)
+
+	manifestResponse, err := endpoint.http.Do(manifestRequest)
+	if err != nil {
+		return Manifest{}, fmt.Errorf("failed to fetch manifest: %w", err)
+	}
+
+	defer manifestResponse.Body.Close()
+
+	if manifestResponse.StatusCode != http.StatusOK {
+		return Manifest{}, newStatusError(manifestResponse)
+	}
+
+	body, err := io.ReadAll(manifestResponse.Body)
+	if err != nil {
+		return Manifest{}, fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	mediaType := manifestResponse.Header.Get("Content-Type")
+	if mediaType == "" || mediaType == "application/json" {
+		// fall back to the media type declared in the manifest itself
+		var manifest struct {
+			MediaType string `json:"mediaType"`
+		}
+		if json.Unmarshal(body, &manifest) == nil {
+			mediaType = manifest.MediaType
+		}
+	}
+
+	manifestDigest := digest.Digest(manifestResponse.Header.Get("Docker-Content-Digest"))
+	if manifestDigest == "" {
+		manifestDigest = digest.FromBytes(body)
+	}
+
+	return Manifest{
+		MediaType: mediaType,
+		Digest:    manifestDigest,
+		Body:      body,
+	}, nil
+}
+
+func (endpoint *endpoint) getBlob(blobDigest digest.Digest) (io.ReadCloser, error) {
+	blobRef, err := reference.WithDigest(endpoint.name, blobDigest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to construct blob reference: %w", err)
+	}
+
+	blobURL, err := endpoint.ub.BuildBlobURL(blobRef)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build blob URL: %w", err)
+	}
+
+	blobRequest, err := http.NewRequest(http.MethodGet, blobURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build blob request: %w", err)
+	}
+	blobRequest.Header.Add("User-Agent", userAgent)
+
+	blobResponse, err := endpoint.http.Do(blobRequest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch blob: %w", err)
+	}
+
+	if blobResponse.StatusCode != http.StatusOK {
+		blobResponse.Body.Close()
+		return nil, newStatusError(blobResponse)
+	}
+
+	return blobResponse.Body, nil
+}
+
+type tagList struct {
+	Name string   `json:"name"`
+	Tags []string `json:"tags"`
+}
+
+func (endpoint *endpoint) listTags() ([]string, error) {
+	tagsURL, err := endpoint.ub.BuildTagsURL(endpoint.name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build tags URL: %w", err)
+	}
+
+	var tags []string
+	for tagsURL != "" {
+		tagsRequest, err := http.NewRequest(http.MethodGet, tagsURL, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build tags request: %w", err)
+		}
+		tagsRequest.Header.Add("Accept", "application/json")
+		tagsRequest.Header.Add("User-Agent", userAgent)
+
+		tagsResponse, err := endpoint.http.Do(tagsRequest)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch tags: %w", err)
+		}
+
+		if tagsResponse.StatusCode != http.StatusOK {
+			tagsResponse.Body.Close()
+			return nil, newStatusError(tagsResponse)
+		}
+
+		var page tagList
+		err = json.NewDecoder(tagsResponse.Body).Decode(&page)
+		tagsResponse.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode tag list: %w", err)
+		}
+
+		tags = append(tags, page.Tags...)
+
+		tagsURL, err = nextPageURL(tagsURL, tagsResponse.Header.Get("Link"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse tag list pagination link: %w", err)
+		}
+	}
+
+	return tags, nil
+}
+
+func (endpoint *endpoint) manifestURL(ref string) (string, error) {
+	var manifestRef reference.Named
+	var err error
+	if manifestDigest, parseErr := digest.Parse(ref); parseErr == nil {
+		manifestRef, err = reference.WithDigest(endpoint.name, manifestDigest)
+	} else {
+		manifestRef, err = reference.WithTag(endpoint.name, ref)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to construct manifest reference: %w", err)
+	}
+
+	manifestURL, err := endpoint.ub.BuildManifestURL(manifestRef)
+	if err != nil {
+		return "", fmt.Errorf("failed to build manifest URL: %w", err)
+	}
+
+	return manifestURL, nil
+}
+
+// nextPageURL resolves the rel="next" entry of an RFC 5988 Link header
+// against the URL of the current page. It returns "" on the last page.
+func nextPageURL(currentURL string, link string) (string, error) {
+	for _, entry := range strings.Split(link, ",") {
+		parts := strings.Split(entry, ";")
+		target := strings.TrimSpace(parts[0])
+		if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+			continue
+		}
+
+		isNext := false
+		for _, param := range parts[1:] {
+			if strings.ReplaceAll(strings.TrimSpace(param), `"`, "") == "rel=next" {
+				isNext = true
+			}
+		}
+
+		if !isNext {
+			continue
+		}
+
+		base, err := url.Parse(currentURL)
+		if err != nil {
+			return "", err
+		}
+
+		next, err := base.Parse(strings.Trim(target, "<>"))
+		if err != nil {
+			return "", err
+		}
+
+		return next.String(), nil
+	}
+
+	return "", nil
+}
@@ -0,0 +1,299 @@
+package registry_test
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"code.cloudfoundry.org/lager/v3/lagertest"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/concourse/docker-image-resource/registry"
+)
+
+const fakeManifest = `{
+  "schemaVersion": 2,
+  "mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+  "config": {
+    "mediaType": "application/vnd.docker.container.image.v1+json",
+    "size": 2,
+    "digest": "sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a"
+  },
+  "layers": []
+}`
+
+var _ = Describe("Client", func() {
+	var (
+		server *ghttp.Server
+		config registry.Config
+		client *registry.Client
+	)
+
+	BeforeEach(func() {
+		server = ghttp.NewServer()
+		server.RouteToHandler("GET", "/v2/", ghttp.RespondWith(http.StatusOK, "{}"))
+
+		interval := registry.Duration(time.Millisecond)
+		config = registry.Config{
+			Repository: server.Addr() + "/some/image",
+			Retry: &registry.RetryPolicy{
+				MaxAttempts:     3,
+				InitialInterval: &interval,
+			},
+		}
+	})
+
+	JustBeforeEach(func() {
+		var err error
+		client, err = registry.NewClient(lagertest.NewTestLogger("registry"), config)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	Describe("ResolveDigest", func() {
+		It("returns the digest from the HEAD response", func() {
+			server.RouteToHandler("HEAD", "/v2/some/image/manifests/latest", ghttp.CombineHandlers(
+				ghttp.VerifyHeaderKV("Accept",
+					"application/vnd.docker.distribution.manifest.v2+json",
+					"application/vnd.oci.image.index.v1+json",
+					"application/json",
+				),
+				ghttp.RespondWith(http.StatusOK, "", http.Header{
+					"Docker-Content-Digest": {"sha256:c4c25c2cd70e3071f08cf124c4b5c656c061dd38247d166d97098d58eeea8aa6"},
+				}),
+			))
+
+			resolved, err := client.ResolveDigest("latest")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resolved).To(Equal("sha256:c4c25c2cd70e3071f08cf124c4b5c656c061dd38247d166d97098d58eeea8aa6"))
+		})
+
+		It("fetches the manifest when the registry does not return a digest", func() {
+			server.RouteToHandler("HEAD", "/v2/some/image/manifests/latest", ghttp.RespondWith(http.StatusOK, ""))
+			server.RouteToHandler("GET", "/v2/some/image/manifests/latest", ghttp.RespondWith(http.StatusOK, fakeManifest, http.Header{
+				"Content-Type": {registry.MediaTypeDockerManifest},
+			}))
+
+			resolved, err := client.ResolveDigest("latest")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resolved).To(Equal(string(digest.FromString(fakeManifest))))
+		})
+
+		It("looks up digests by digest", func() {
+			server.RouteToHandler("HEAD", "/v2/some/image/manifests/sha256:c4c25c2cd70e3071f08cf124c4b5c656c061dd38247d166d97098d58eeea8aa6", ghttp.RespondWith(http.StatusOK, "", http.Header{
+				"Docker-Content-Digest": {"sha256:c4c25c2cd70e3071f08cf124c4b5c656c061dd38247d166d97098d58eeea8aa6"},
+			}))
+
+			resolved, err := client.ResolveDigest("sha256:c4c25c2cd70e3071f08cf124c4b5c656c061dd38247d166d97098d58eeea8aa6")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resolved).To(Equal("sha256:c4c25c2cd70e3071f08cf124c4b5c656c061dd38247d166d97098d58eeea8aa6"))
+		})
+
+		It("returns an error matching ErrNotFound for missing manifests", func() {
+			server.RouteToHandler("HEAD", "/v2/some/image/manifests/missing", ghttp.RespondWith(http.StatusNotFound, ""))
+
+			_, err := client.ResolveDigest("missing")
+			Expect(errors.Is(err, registry.ErrNotFound)).To(BeTrue())
+		})
+
+		It("returns a status error for other failures", func() {
+			server.RouteToHandler("HEAD", "/v2/some/image/manifests/latest", ghttp.RespondWith(http.StatusUnauthorized, ""))
+
+			_, err := client.ResolveDigest("latest")
+
+			var statusErr *registry.StatusError
+			Expect(errors.As(err, &statusErr)).To(BeTrue())
+			Expect(statusErr.StatusCode).To(Equal(http.StatusUnauthorized))
+			Expect(errors.Is(err, registry.ErrNotFound)).To(BeFalse())
+		})
+	})
+
+	Describe("StatusError", func() {
+		It("includes the errors reported by the registry", func() {
+			server.RouteToHandler("GET", "/v2/some/image/manifests/latest", ghttp.RespondWith(http.StatusTooManyRequests,
+				`{"errors":[{"code":"TOOMANYREQUESTS","message":"You have reached your pull rate limit."}]}`,
+				http.Header{"Content-Type": {"application/json"}},
+			))
+
+			_, err := client.GetManifest("latest")
+
+			var statusErr *registry.StatusError
+			Expect(errors.As(err, &statusErr)).To(BeTrue())
+			Expect(statusErr.Code()).To(Equal(registry.ErrorCodeTooManyRequests))
+			Expect(statusErr.Errors[0].Message).To(Equal("You have reached your pull rate limit."))
+			Expect(err.Error()).To(ContainSubstring("TOOMANYREQUESTS: You have reached your pull rate limit."))
+		})
+	})
+
+	Describe("retries", func() {
+		var attempts int
+
+		respondAfter := func(failures int, failure http.HandlerFunc) http.HandlerFunc {
+			attempts = 0
+			return func(w http.ResponseWriter, r *http.Request) {
+				attempts++
+				if attempts <= failures {
+					failure(w, r)
+					return
+				}
+				w.Header().Set("Docker-Content-Digest", "sha256:c4c25c2cd70e3071f08cf124c4b5c656c061dd38247d166d97098d58eeea8aa6")
+			}
+		}
+
+		DescribeTable("retries transient failures",
+			func(failure http.HandlerFunc) {
+				server.RouteToHandler("HEAD", "/v2/some/image/manifests/latest", respondAfter(2, failure))
+
+				_, err := client.ResolveDigest("latest")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(attempts).To(Equal(3))
+			},
+			Entry("server errors", ghttp.RespondWith(http.StatusServiceUnavailable, "")),
+			Entry("rate limiting without Retry-After", ghttp.RespondWith(http.StatusTooManyRequests, "")),
+			Entry("connection resets", func(w http.ResponseWriter, r *http.Request) {
+				conn, _, err := w.(http.Hijacker).Hijack()
+				Expect(err).ToNot(HaveOccurred())
+				conn.(*net.TCPConn).SetLinger(0)
+				conn.Close()
+			}),
+		)
+
+		It("gives up after max_attempts", func() {
+			server.RouteToHandler("HEAD", "/v2/some/image/manifests/latest", respondAfter(3, ghttp.RespondWith(http.StatusBadGateway, "")))
+
+			_, err := client.ResolveDigest("latest")
+
+			var statusErr *registry.StatusError
+			Expect(errors.As(err, &statusErr)).To(BeTrue())
+			Expect(statusErr.StatusCode).To(Equal(http.StatusBadGateway))
+			Expect(attempts).To(Equal(3))
+		})
+
+		It("gives up once max_elapsed has passed", func() {
+			maxElapsed := registry.Duration(0)
+			config.Retry.MaxAttempts = 0
+			config.Retry.MaxElapsed = &maxElapsed
+
+			server.RouteToHandler("HEAD", "/v2/some/image/manifests/latest", respondAfter(1, ghttp.RespondWith(http.StatusBadGateway, "")))
+
+			_, err := client.ResolveDigest("latest")
+			Expect(err).To(HaveOccurred())
+			Expect(attempts).To(Equal(1))
+		})
+
+		It("does not retry other failures", func() {
+			server.RouteToHandler("HEAD", "/v2/some/image/manifests/latest", respondAfter(1, ghttp.RespondWith(http.StatusForbidden, "")))
+
+			_, err := client.ResolveDigest("latest")
+			Expect(err).To(HaveOccurred())
+			Expect(attempts).To(Equal(1))
+		})
+	})
+
+	Describe("timeout", func() {
+		BeforeEach(func() {
+			timeout := registry.Duration(50 * time.Millisecond)
+			config.Timeout = &timeout
+			config.Retry.MaxAttempts = 1
+		})
+
+		It("fails requests which take longer to respond", func() {
+			server.RouteToHandler("HEAD", "/v2/some/image/manifests/latest", func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(200 * time.Millisecond)
+			})
+
+			_, err := client.ResolveDigest("latest")
+			Expect(err).To(MatchError(ContainSubstring("timeout awaiting response headers")))
+		})
+	})
+
+	Describe("HeadManifest", func() {
+		It("returns the media type and digest without fetching the manifest", func() {
+			server.RouteToHandler("HEAD", "/v2/some/image/manifests/latest", ghttp.RespondWith(http.StatusOK, "", http.Header{
+				"Content-Type":          {ocispec.MediaTypeImageIndex},
+				"Docker-Content-Digest": {"sha256:c4c25c2cd70e3071f08cf124c4b5c656c061dd38247d166d97098d58eeea8aa6"},
+			}))
+
+			manifest, err := client.HeadManifest("latest")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(manifest.IsIndex()).To(BeTrue())
+			Expect(manifest.Digest).To(Equal(digest.Digest("sha256:c4c25c2cd70e3071f08cf124c4b5c656c061dd38247d166d97098d58eeea8aa6")))
+			Expect(manifest.Body).To(BeEmpty())
+		})
+	})
+
+	Describe("GetManifest", func() {
+		It("returns the manifest with its media type and digest", func() {
+			server.RouteToHandler("GET", "/v2/some/image/manifests/latest", ghttp.RespondWith(http.StatusOK, fakeManifest, http.Header{
+				"Content-Type": {"application/json"},
+			}))
+
+			manifest, err := client.GetManifest("latest")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(manifest.MediaType).To(Equal(registry.MediaTypeDockerManifest))
+			Expect(manifest.Digest).To(Equal(digest.FromString(fakeManifest)))
+			Expect(string(manifest.Body)).To(Equal(fakeManifest))
+			Expect(manifest.IsIndex()).To(BeFalse())
+		})
+
+		It("recognizes image indexes", func() {
+			server.RouteToHandler("GET", "/v2/some/image/manifests/latest", ghttp.RespondWith(http.StatusOK, `{"manifests":[]}`, http.Header{
+				"Content-Type":          {ocispec.MediaTypeImageIndex},
+				"Docker-Content-Digest": {"sha256:c4c25c2cd70e3071f08cf124c4b5c656c061dd38247d166d97098d58eeea8aa6"},
+			}))
+
+			manifest, err := client.GetManifest("latest")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(manifest.IsIndex()).To(BeTrue())
+			Expect(manifest.Digest).To(Equal(digest.Digest("sha256:c4c25c2cd70e3071f08cf124c4b5c656c061dd38247d166d97098d58eeea8aa6")))
+		})
+	})
+
+	Describe("GetBlob", func() {
+		It("streams the blob", func() {
+			blobDigest := digest.FromString("{}")
+			server.RouteToHandler("GET", "/v2/some/image/blobs/"+blobDigest.String(), ghttp.RespondWith(http.StatusOK, "{}"))
+
+			blob, err := client.GetBlob(blobDigest)
+			Expect(err).ToNot(HaveOccurred())
+			defer blob.Close()
+
+			contents, err := io.ReadAll(blob)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(contents)).To(Equal("{}"))
+		})
+
+		It("returns an error matching ErrNotFound for missing blobs", func() {
+			server.RouteToHandler("GET", "/v2/some/image/blobs/"+digest.FromString("missing").String(), ghttp.RespondWith(http.StatusNotFound, ""))
+
+			_, err := client.GetBlob(digest.FromString("missing"))
+			Expect(errors.Is(err, registry.ErrNotFound)).To(BeTrue())
+		})
+	})
+
+	Describe("ListTags", func() {
+		It("follows the pagination links", func() {
+			server.RouteToHandler("GET", "/v2/some/image/tags/list", func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Query().Get("last") == "" {
+					w.Header().Set("Link", `</v2/some/image/tags/list?last=b&n=2>; rel="next"`)
+					w.Write([]byte(`{"name":"some/image","tags":["a","b"]}`))
+					return
+				}
+				w.Write([]byte(`{"name":"some/image","tags":["c"]}`))
+			})
+
+			tags, err := client.ListTags()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(tags).To(Equal([]string{"a", "b", "c"}))
+		})
+	})
+})
@@ -0,0 +1,94 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Config describes how to reach and authenticate against the registry of a
+// repository. It is meant to be embedded in the source configuration of each
+// of the resource's commands so that they all share the same semantics.
+type Config struct {
+	Repository    string        `json:"repository"`
+	Username      string        `json:"username"`
+	Password      string        `json:"password"`
+	IdentityToken string        `json:"identity_token"`
+	RegistryToken string        `json:"registry_token"`
+	DockerConfig  *DockerConfig `json:"docker_config"`
+
+	AdditionalPrivateRegistries []PrivateRegistry `json:"additional_private_registries"`
+
+	InsecureRegistries []string        `json:"insecure_registries"`
+	DomainCerts        []DomainCert    `json:"ca_certs"`
+	ClientCerts        []ClientCertKey `json:"client_certs"`
+
+	RateLimitWait *Duration    `json:"rate_limit_wait"`
+	Retry         *RetryPolicy `json:"retry"`
+	Timeout       *Duration    `json:"timeout"`
+
+	Debug bool `json:"debug"`
+
+	RegistryMirror        string                      `json:"registry_mirror"`
+	RegistryMirrors       []RegistryMirror            `json:"registry_mirrors"`
+	RegistryMirrorsByHost map[string][]RegistryMirror `json:"registry_mirrors_by_host"`
+
+	AWSAccessKeyID     string `json:"aws_access_key_id"`
+	AWSSecretAccessKey string `json:"aws_secret_access_key"`
+	AWSSessionToken    string `json:"aws_session_token"`
+	AWSRegion          string `json:"aws_region"`
+	AWSRoleARN         string `json:"aws_role_arn"`
+	AWSExternalID      string `json:"aws_external_id"`
+
+	AWSWebIdentityTokenFile string `json:"aws_web_identity_token_file"`
+	AWSEndpoint             string `json:"aws_endpoint"`
+
+	ECR *ECRConfig `json:"ecr"`
+
+	GCPServiceAccountKey *GCPServiceAccountKey `json:"gcp_service_account_key"`
+	Azure                *AzureConfig          `json:"azure"`
+}
+
+// PrivateRegistry holds the credentials for a registry other than the one
+// hosting the repository, e.g. a mirror.
+type PrivateRegistry struct {
+	Registry string `json:"registry"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type DomainCert struct {
+	Domain string `json:"domain"`
+	Cert   string `json:"cert"`
+}
+
+type ClientCertKey struct {
+	Domain string `json:"domain"`
+	Cert   string `json:"cert"`
+	Key    string `json:"key"`
+}
+
+// Duration is a time.Duration configured as either a number of seconds or a
+// duration string such as "1m30s".
+type Duration time.Duration
+
+// UnmarshalJSON accepts numeric and string values.
+func (duration *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		parsed, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		*duration = Duration(parsed)
+		return nil
+	}
+
+	var seconds float64
+	if err := json.Unmarshal(b, &seconds); err != nil {
+		return fmt.Errorf("invalid duration %s: must be a number of seconds or a duration string", b)
+	}
+
+	*duration = Duration(seconds * float64(time.Second))
+	return nil
+}
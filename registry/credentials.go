@@ -0,0 +1,322 @@
+package registry
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/docker/distribution/registry/client/auth/challenge"
+	"github.com/docker/docker-credential-helpers/client"
+	"github.com/docker/docker-credential-helpers/credentials"
+)
+
+// dockerHubServerURL is the key under which Docker stores credentials for
+// Docker Hub.
+const dockerHubServerURL = "https://index.docker.io/v1/"
+
+// DockerConfig is the subset of a Docker config.json used to look up
+// registry credentials.
+type DockerConfig struct {
+	Auths       map[string]DockerAuth `json:"auths"`
+	CredsStore  string                `json:"credsStore"`
+	CredHelpers map[string]string     `json:"credHelpers"`
+}
+
+// DockerAuth is an entry of the auths in a Docker config.json.
+type DockerAuth struct {
+	Auth          string `json:"auth"`
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	IdentityToken string `json:"identitytoken"`
+	RegistryToken string `json:"registrytoken"`
+}
+
+// Credentials authenticate against a registry, either with a username and
+// password, with an identity token exchanged for access tokens through an
+// OAuth2 refresh token grant, or with a bearer token sent to the registry as
+// is.
+type Credentials struct {
+	Username      string
+	Password      string
+	IdentityToken string
+	RegistryToken string
+}
+
+// tokenUsername is the username credential helpers return along with an
+// identity token as the secret.
+const tokenUsername = "<token>"
+
+// UnmarshalJSON accepts the config either as an object or as a string
+// containing its JSON, e.g. when it is interpolated from a credential manager.
+func (config *DockerConfig) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		b = []byte(s)
+	}
+
+	type dockerConfig DockerConfig
+	var parsed dockerConfig
+	if err := json.Unmarshal(b, &parsed); err != nil {
+		return fmt.Errorf("invalid docker_config: %w", err)
+	}
+
+	*config = DockerConfig(parsed)
+	return nil
+}
+
+// Credentials looks up the credentials for a registry host the same way
+// docker does: from the host's credential helper if it has one, otherwise
+// from the default credential store if one is configured, otherwise from
+// auths. Empty credentials are returned if none are found.
+func (config DockerConfig) Credentials(registryHost string) (Credentials, error) {
+	serverURL := registryHost
+	if registryHost == officialRegistry {
+		serverURL = dockerHubServerURL
+	}
+
+	helper := config.CredsStore
+	for host, hostHelper := range config.CredHelpers {
+		if sameRegistryHost(host, serverURL) {
+			helper = hostHelper
+		}
+	}
+
+	if helper != "" {
+		creds, err := client.Get(client.NewShellProgramFunc("docker-credential-"+helper), serverURL)
+		if err != nil {
+			if credentials.IsErrCredentialsNotFound(err) {
+				return Credentials{}, nil
+			}
+
+			return Credentials{}, fmt.Errorf("credential helper %s: %w", helper, err)
+		}
+
+		if creds.Username == tokenUsername {
+			return Credentials{IdentityToken: creds.Secret}, nil
+		}
+
+		return Credentials{Username: creds.Username, Password: creds.Secret}, nil
+	}
+
+	for host, entry := range config.Auths {
+		if !sameRegistryHost(host, serverURL) {
+			continue
+		}
+
+		creds := Credentials{
+			Username:      entry.Username,
+			Password:      entry.Password,
+			IdentityToken: entry.IdentityToken,
+			RegistryToken: entry.RegistryToken,
+		}
+
+		if entry.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil {
+				return Credentials{}, fmt.Errorf("invalid auth for %s: %w", host, err)
+			}
+
+			var ok bool
+			creds.Username, creds.Password, ok = strings.Cut(string(decoded), ":")
+			if !ok {
+				return Credentials{}, fmt.Errorf("invalid auth for %s: must be of the form username:password", host)
+			}
+		}
+
+		return creds, nil
+	}
+
+	return Credentials{}, nil
+}
+
+// sameRegistryHost reports whether two registries, given as hosts or as URLs
+// (as config.json keys may be for historical reasons), are the same. The
+// aliases of Docker Hub are considered the same registry.
+func sameRegistryHost(a, b string) bool {
+	return convertToHostname(a) == convertToHostname(b)
+}
+
+// convertToHostname strips the scheme and path from a registry.
+func convertToHostname(serverURL string) string {
+	hostname := strings.TrimPrefix(serverURL, "https://")
+	hostname = strings.TrimPrefix(hostname, "http://")
+	hostname, _, _ = strings.Cut(hostname, "/")
+
+	switch hostname {
+	case "docker.io", "index.docker.io", officialRegistry:
+		return officialRegistry
+	}
+
+	return hostname
+}
+
+// credentialStore provides the credentials of each host to the
+// authorization handlers, and keeps the refresh tokens issued by token
+// servers for the life of the process.
+type credentialStore struct {
+	credentials map[string]Credentials
+
+	refreshTokens map[string]string
+	lock          sync.Mutex
+}
+
+// newCredentialStore resolves the credentials for the registry host, which
+// are also sent to the token realms the registry challenged with.
+func newCredentialStore(config Config, registryHost string, pingResp *http.Response) (*credentialStore, error) {
+	creds, err := config.credentials(registryHost)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get credentials for %s: %w", registryHost, err)
+	}
+
+	store := &credentialStore{
+		credentials: map[string]Credentials{
+			registryHost: creds,
+		},
+		refreshTokens: map[string]string{},
+	}
+
+	for _, c := range challenge.ResponseChallenges(pingResp) {
+		realm, err := url.Parse(c.Parameters["realm"])
+		if err != nil || realm.Host == "" {
+			continue
+		}
+
+		store.credentials[realm.Host] = creds
+	}
+
+	return store, nil
+}
+
+// LoginCredentials returns the username and password with which to log in
+// to the repository's registry, e.g. with docker login, exchanging the
+// configured ECR, GCP or Azure credentials for them if necessary.
+func LoginCredentials(config Config) (string, string, error) {
+	if config.IsECR(config.Repository) {
+		return ECRCredentials(config)
+	}
+
+	registryHost, _, err := ParseRepository(config.Repository)
+	if err != nil {
+		return "", "", err
+	}
+
+	creds, err := config.credentials(registryHost)
+	if err != nil {
+		return "", "", err
+	}
+
+	return creds.Username, creds.Password, nil
+}
+
+// credentials chooses the credentials for a registry host. The source's own
+// credentials belong to the repository's registry, or are exchanged for
+// with gcp_service_account_key or azure if none are given, while the
+// credentials of any other registry (such as a mirror) are taken from
+// additional_private_registries. Otherwise the source's credentials are used
+// as long as any are given, falling back to docker_config.
+func (config Config) credentials(registryHost string) (Credentials, error) {
+	creds := Credentials{
+		Username:      config.Username,
+		Password:      config.Password,
+		IdentityToken: config.IdentityToken,
+		RegistryToken: config.RegistryToken,
+	}
+
+	repositoryHost, _, err := ParseRepository(config.Repository)
+	if err != nil {
+		return Credentials{}, err
+	}
+
+	if creds == (Credentials{}) && sameRegistryHost(registryHost, repositoryHost) {
+		creds, err = config.exchangedCredentials(registryHost)
+		if err != nil {
+			return Credentials{}, err
+		}
+	}
+
+	if creds == (Credentials{}) || !sameRegistryHost(registryHost, repositoryHost) {
+		for _, additional := range config.AdditionalPrivateRegistries {
+			if sameRegistryHost(additional.Registry, registryHost) {
+				return Credentials{Username: additional.Username, Password: additional.Password}, nil
+			}
+		}
+	}
+
+	if creds == (Credentials{}) && config.DockerConfig != nil {
+		return config.DockerConfig.Credentials(registryHost)
+	}
+
+	return creds, nil
+}
+
+// exchangedCredentials exchanges the configured GCP or Azure credentials for
+// credentials to the registry, if any are configured.
+func (config Config) exchangedCredentials(registryHost string) (Credentials, error) {
+	if config.GCPServiceAccountKey == nil && config.Azure == nil {
+		return Credentials{}, nil
+	}
+
+	client, err := newTokenClient(config)
+	if err != nil {
+		return Credentials{}, err
+	}
+
+	if config.GCPServiceAccountKey != nil {
+		return gcpCredentials(client, *config.GCPServiceAccountKey)
+	}
+
+	return azureCredentials(client, *config.Azure, registryHost)
+}
+
+func (store *credentialStore) Basic(u *url.URL) (string, string) {
+	creds := store.credentials[u.Host]
+	return creds.Username, creds.Password
+}
+
+// RefreshToken returns the latest refresh token issued by the realm for the
+// service, falling back to the configured identity token.
+func (store *credentialStore) RefreshToken(realm *url.URL, service string) string {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if token, found := store.refreshTokens[refreshTokenKey(realm, service)]; found {
+		return token
+	}
+
+	return store.credentials[realm.Host].IdentityToken
+}
+
+func (store *credentialStore) SetRefreshToken(realm *url.URL, service, token string) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.refreshTokens[refreshTokenKey(realm, service)] = token
+}
+
+func refreshTokenKey(realm *url.URL, service string) string {
+	return realm.String() + " " + service
+}
+
+// registryToken returns the bearer token configured for the registry, if any.
+func (store *credentialStore) registryToken(registryHost string) string {
+	return store.credentials[registryHost].RegistryToken
+}
+
+// bearerHandler answers bearer challenges with a fixed token instead of
+// fetching one from the token server.
+type bearerHandler struct {
+	token string
+}
+
+func (bearerHandler) Scheme() string {
+	return "bearer"
+}
+
+func (handler bearerHandler) AuthorizeRequest(req *http.Request, params map[string]string) error {
+	req.Header.Set("Authorization", "Bearer "+handler.token)
+	return nil
+}
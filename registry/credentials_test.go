@@ -0,0 +1,276 @@
+package registry_test
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/lager/v3/lagertest"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+
+	"github.com/concourse/docker-image-resource/registry"
+)
+
+// fakeHelper responds to "get" with credentials for registry.example.com and
+// reports any other server as not found, like docker-credential-* helpers do.
+const fakeHelper = `#!/bin/sh
+read server
+if [ "$1" = get ] && [ "$server" = registry.example.com ]; then
+  echo '{"ServerURL":"registry.example.com","Username":"helper-user","Secret":"helper-secret"}'
+  exit 0
+fi
+if [ "$1" = get ] && [ "$server" = token.example.com ]; then
+  echo '{"ServerURL":"token.example.com","Username":"<token>","Secret":"helper-token"}'
+  exit 0
+fi
+echo "credentials not found in native keychain"
+exit 1
+`
+
+var _ = Describe("DockerConfig", func() {
+	auth := func(username, password string) string {
+		return base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+	}
+
+	parse := func(config string) registry.DockerConfig {
+		var dockerConfig registry.DockerConfig
+		Expect(json.Unmarshal([]byte(config), &dockerConfig)).To(Succeed())
+		return dockerConfig
+	}
+
+	It("looks up credentials in auths by host", func() {
+		dockerConfig := parse(`{"auths":{"https://registry.example.com/v2/":{"auth":"` + auth("some-user", "some:password") + `"}}}`)
+
+		creds, err := dockerConfig.Credentials("registry.example.com")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(creds).To(Equal(registry.Credentials{Username: "some-user", Password: "some:password"}))
+
+		creds, err = dockerConfig.Credentials("other.example.com")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(creds).To(BeZero())
+	})
+
+	It("looks up Docker Hub credentials under its index URL", func() {
+		dockerConfig := parse(`{"auths":{"https://index.docker.io/v1/":{"username":"hub-user","password":"hub-password"}}}`)
+
+		creds, err := dockerConfig.Credentials("registry-1.docker.io")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(creds).To(Equal(registry.Credentials{Username: "hub-user", Password: "hub-password"}))
+	})
+
+	It("accepts the config as a JSON string", func() {
+		dockerConfig := parse(`"{\"auths\":{\"registry.example.com\":{\"username\":\"some-user\",\"password\":\"some-password\"}}}"`)
+
+		creds, err := dockerConfig.Credentials("registry.example.com")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(creds.Username).To(Equal("some-user"))
+	})
+
+	It("returns the identity and registry tokens from auths", func() {
+		dockerConfig := parse(`{"auths":{"registry.example.com":{"identitytoken":"some-identity-token","registrytoken":"some-registry-token"}}}`)
+
+		creds, err := dockerConfig.Credentials("registry.example.com")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(creds).To(Equal(registry.Credentials{IdentityToken: "some-identity-token", RegistryToken: "some-registry-token"}))
+	})
+
+	Context("with credential helpers", func() {
+		BeforeEach(func() {
+			dir := GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(dir, "docker-credential-fake"), []byte(fakeHelper), 0755)).To(Succeed())
+			GinkgoT().Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+		})
+
+		It("prefers the host's credential helper over auths", func() {
+			dockerConfig := parse(`{
+				"auths":{"registry.example.com":{"username":"some-user","password":"some-password"}},
+				"credHelpers":{"registry.example.com":"fake"}
+			}`)
+
+			creds, err := dockerConfig.Credentials("registry.example.com")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(creds).To(Equal(registry.Credentials{Username: "helper-user", Password: "helper-secret"}))
+		})
+
+		It("uses the credential store for every host", func() {
+			dockerConfig := parse(`{"credsStore":"fake"}`)
+
+			creds, err := dockerConfig.Credentials("registry.example.com")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(creds.Username).To(Equal("helper-user"))
+
+			creds, err = dockerConfig.Credentials("other.example.com")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(creds).To(BeZero())
+		})
+
+		It("returns identity tokens from helpers", func() {
+			dockerConfig := parse(`{"credsStore":"fake"}`)
+
+			creds, err := dockerConfig.Credentials("token.example.com")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(creds).To(Equal(registry.Credentials{IdentityToken: "helper-token"}))
+		})
+
+		It("fails when the helper cannot be run", func() {
+			dockerConfig := parse(`{"credsStore":"missing"}`)
+
+			_, err := dockerConfig.Credentials("registry.example.com")
+			Expect(err).To(MatchError(ContainSubstring("credential helper missing")))
+		})
+	})
+
+	Describe("authenticating a client", func() {
+		var server *ghttp.Server
+
+		BeforeEach(func() {
+			server = ghttp.NewServer()
+			server.RouteToHandler("GET", "/v2/", ghttp.RespondWith(http.StatusUnauthorized, "", http.Header{
+				"WWW-Authenticate": {`Basic realm="registry"`},
+			}))
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		It("sends the credentials of additional_private_registries to a mirror", func() {
+			server.RouteToHandler("HEAD", "/v2/library/ubuntu/manifests/latest", ghttp.CombineHandlers(
+				ghttp.VerifyBasicAuth("mirror-user", "mirror-password"),
+				ghttp.RespondWith(http.StatusOK, "", http.Header{
+					"Docker-Content-Digest": {"sha256:c4c25c2cd70e3071f08cf124c4b5c656c061dd38247d166d97098d58eeea8aa6"},
+				}),
+			))
+
+			client, err := registry.NewClient(lagertest.NewTestLogger("registry"), registry.Config{
+				Repository:     "ubuntu",
+				Username:       "hub-user",
+				Password:       "hub-password",
+				RegistryMirror: server.URL(),
+				AdditionalPrivateRegistries: []registry.PrivateRegistry{
+					{Registry: "other.example.com", Username: "other-user", Password: "other-password"},
+					{Registry: server.Addr() + "/some/path", Username: "mirror-user", Password: "mirror-password"},
+				},
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = client.ResolveDigest("latest")
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("sends the credentials of additional_private_registries for the repository's registry when none are given", func() {
+			server.RouteToHandler("HEAD", "/v2/some/image/manifests/latest", ghttp.CombineHandlers(
+				ghttp.VerifyBasicAuth("some-user", "some-password"),
+				ghttp.RespondWith(http.StatusOK, "", http.Header{
+					"Docker-Content-Digest": {"sha256:c4c25c2cd70e3071f08cf124c4b5c656c061dd38247d166d97098d58eeea8aa6"},
+				}),
+			))
+
+			client, err := registry.NewClient(lagertest.NewTestLogger("registry"), registry.Config{
+				Repository: server.Addr() + "/some/image",
+				AdditionalPrivateRegistries: []registry.PrivateRegistry{
+					{Registry: server.Addr(), Username: "some-user", Password: "some-password"},
+				},
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = client.ResolveDigest("latest")
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("sends the credentials found for the registry host", func() {
+			server.RouteToHandler("HEAD", "/v2/some/image/manifests/latest", ghttp.CombineHandlers(
+				ghttp.VerifyBasicAuth("some-user", "some-password"),
+				ghttp.RespondWith(http.StatusOK, "", http.Header{
+					"Docker-Content-Digest": {"sha256:c4c25c2cd70e3071f08cf124c4b5c656c061dd38247d166d97098d58eeea8aa6"},
+				}),
+			))
+
+			dockerConfig := parse(`{"auths":{"` + server.Addr() + `":{"auth":"` + auth("some-user", "some-password") + `"}}}`)
+
+			client, err := registry.NewClient(lagertest.NewTestLogger("registry"), registry.Config{
+				Repository:   server.Addr() + "/some/image",
+				DockerConfig: &dockerConfig,
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = client.ResolveDigest("latest")
+			Expect(err).ToNot(HaveOccurred())
+		})
+	})
+})
+
+var _ = Describe("Token authentication", func() {
+	var (
+		server *ghttp.Server
+		config registry.Config
+	)
+
+	BeforeEach(func() {
+		server = ghttp.NewServer()
+		server.RouteToHandler("GET", "/v2/", ghttp.RespondWith(http.StatusUnauthorized, "", http.Header{
+			"WWW-Authenticate": {`Bearer realm="` + server.URL() + `/token",service="some-registry"`},
+		}))
+		server.RouteToHandler("HEAD", "/v2/some/image/manifests/latest", ghttp.CombineHandlers(
+			ghttp.VerifyHeaderKV("Authorization", "Bearer some-access-token"),
+			ghttp.RespondWith(http.StatusOK, "", http.Header{
+				"Docker-Content-Digest": {"sha256:c4c25c2cd70e3071f08cf124c4b5c656c061dd38247d166d97098d58eeea8aa6"},
+			}),
+		))
+
+		config = registry.Config{
+			Repository: server.Addr() + "/some/image",
+		}
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	resolve := func() error {
+		client, err := registry.NewClient(lagertest.NewTestLogger("registry"), config)
+		Expect(err).ToNot(HaveOccurred())
+
+		_, err = client.ResolveDigest("latest")
+		return err
+	}
+
+	Context("with an identity token", func() {
+		BeforeEach(func() {
+			config.IdentityToken = "some-identity-token"
+		})
+
+		It("exchanges it for an access token with a refresh token grant", func() {
+			server.RouteToHandler("POST", "/token", ghttp.CombineHandlers(
+				func(w http.ResponseWriter, r *http.Request) {
+					Expect(r.ParseForm()).To(Succeed())
+					Expect(r.PostForm.Get("grant_type")).To(Equal("refresh_token"))
+					Expect(r.PostForm.Get("refresh_token")).To(Equal("some-identity-token"))
+					Expect(r.PostForm.Get("service")).To(Equal("some-registry"))
+					Expect(r.PostForm.Get("scope")).To(Equal("repository:some/image:pull"))
+				},
+				ghttp.RespondWith(http.StatusOK, `{"access_token":"some-access-token","refresh_token":"some-refresh-token"}`),
+			))
+
+			Expect(resolve()).To(Succeed())
+		})
+	})
+
+	Context("with a registry token", func() {
+		BeforeEach(func() {
+			config.RegistryToken = "some-access-token"
+		})
+
+		It("sends it to the registry without contacting the token server", func() {
+			Expect(resolve()).To(Succeed())
+
+			for _, request := range server.ReceivedRequests() {
+				Expect(request.URL.Path).ToNot(Equal("/token"))
+			}
+		})
+	})
+})
@@ -0,0 +1,198 @@
+package registry
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"code.cloudfoundry.org/lager/v3"
+	"github.com/docker/distribution/registry/client/auth/challenge"
+)
+
+const redacted = "[REDACTED]"
+
+// debugHeaders are the headers logged with each request and response, none
+// of which carry credentials. Location is logged separately, redacted, as
+// redirects to storage backends carry pre-signed URLs.
+var debugHeaders = []string{
+	"Accept",
+	"Content-Type",
+	"Content-Length",
+	"Docker-Content-Digest",
+	"Docker-Distribution-Api-Version",
+	"Docker-Ratelimit-Source",
+	"Link",
+	"Ratelimit-Limit",
+	"Ratelimit-Remaining",
+	"Retry-After",
+}
+
+// debugFormFields are the fields of token requests which are logged, as
+// opposed to the credentials sent along with them.
+var debugFormFields = []string{
+	"grant_type",
+	"service",
+	"scope",
+	"client_id",
+	"access_type",
+}
+
+// sensitiveQueryParams are redacted from logged URLs when they appear in
+// the name of a query parameter, regardless of case, so as to also cover the
+// pre-signed URLs of storage backends which blobs are redirected to (e.g.
+// X-Amz-Signature, X-Goog-Credential or Azure's sig).
+var sensitiveQueryParams = []string{
+	"token",
+	"signature",
+	"credential",
+	"sig",
+	"secret",
+	"password",
+	"assertion",
+}
+
+// debugRoundTripper logs every request and response at debug level when
+// source.debug is set, including the challenges of the registry and the
+// scopes requested from token servers. Credentials are never logged.
+type debugRoundTripper struct {
+	logger lager.Logger
+	rt     http.RoundTripper
+}
+
+func newDebugRoundTripper(logger lager.Logger, rt http.RoundTripper) *debugRoundTripper {
+	return &debugRoundTripper{
+		logger: logger.Session("debug"),
+		rt:     rt,
+	}
+}
+
+func (rt *debugRoundTripper) RoundTrip(request *http.Request) (*http.Response, error) {
+	requestURL := redactURL(request.URL)
+
+	data := lager.Data{
+		"method": request.Method,
+		"url":    requestURL,
+	}
+
+	if authorization := request.Header.Get("Authorization"); authorization != "" {
+		scheme, _, _ := strings.Cut(authorization, " ")
+		data["authorization"] = scheme + " " + redacted
+	}
+
+	addDebugHeaders(data, request.Header)
+
+	if form := tokenRequestForm(request); len(form) > 0 {
+		data["form"] = form
+	}
+
+	rt.logger.Debug("request", data)
+
+	response, err := rt.rt.RoundTrip(request)
+	if err != nil {
+		rt.logger.Debug("failed", lager.Data{
+			"url":   requestURL,
+			"error": err.Error(),
+		})
+		return nil, err
+	}
+
+	data = lager.Data{
+		"url":    requestURL,
+		"status": response.Status,
+	}
+
+	addDebugHeaders(data, response.Header)
+
+	var challenges []lager.Data
+	for _, c := range challenge.ResponseChallenges(response) {
+		challenges = append(challenges, lager.Data{
+			"scheme":     c.Scheme,
+			"parameters": c.Parameters,
+		})
+	}
+	if len(challenges) > 0 {
+		data["challenges"] = challenges
+	}
+
+	rt.logger.Debug("response", data)
+
+	return response, nil
+}
+
+func addDebugHeaders(data lager.Data, header http.Header) {
+	for _, name := range debugHeaders {
+		if value := header.Get(name); value != "" {
+			data[strings.ToLower(name)] = value
+		}
+	}
+
+	if location := header.Get("Location"); location != "" {
+		locationURL, err := url.Parse(location)
+		if err != nil {
+			data["location"] = redacted
+		} else {
+			data["location"] = redactURL(locationURL)
+		}
+	}
+}
+
+// tokenRequestForm returns the fields of a form posted to a token server
+// which describe what is requested, such as its scopes.
+func tokenRequestForm(request *http.Request) map[string]string {
+	if request.GetBody == nil || request.Header.Get("Content-Type") != "application/x-www-form-urlencoded" {
+		return nil
+	}
+
+	body, err := request.GetBody()
+	if err != nil {
+		return nil
+	}
+	defer body.Close()
+
+	raw, err := io.ReadAll(body)
+	if err != nil {
+		return nil
+	}
+
+	values, err := url.ParseQuery(string(raw))
+	if err != nil {
+		return nil
+	}
+
+	form := map[string]string{}
+	for _, field := range debugFormFields {
+		if value := values.Get(field); value != "" {
+			form[field] = value
+		}
+	}
+
+	return form
+}
+
+// redactURL returns the URL with its user info and any tokens or secrets in
+// its query redacted.
+func redactURL(u *url.URL) string {
+	redactedURL := *u
+
+	query := redactedURL.Query()
+	for param := range query {
+		if sensitiveQueryParam(param) {
+			query.Set(param, redacted)
+		}
+	}
+	redactedURL.RawQuery = query.Encode()
+
+	return redactedURL.Redacted()
+}
+
+func sensitiveQueryParam(param string) bool {
+	param = strings.ToLower(param)
+	for _, sensitive := range sensitiveQueryParams {
+		if strings.Contains(param, sensitive) {
+			return true
+		}
+	}
+
+	return false
+}
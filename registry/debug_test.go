@@ -0,0 +1,209 @@
+package registry_test
+
+import (
+	"io"
+	"net/http"
+
+	"code.cloudfoundry.org/lager/v3/lagertest"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+	digest "github.com/opencontainers/go-digest"
+
+	"github.com/concourse/docker-image-resource/registry"
+)
+
+var _ = Describe("Debug logging", func() {
+	var (
+		server *ghttp.Server
+		logger *lagertest.TestLogger
+		config registry.Config
+	)
+
+	BeforeEach(func() {
+		server = ghttp.NewServer()
+		server.RouteToHandler("GET", "/v2/", ghttp.RespondWith(http.StatusUnauthorized, "", http.Header{
+			"WWW-Authenticate": {`Bearer realm="` + server.URL() + `/token",service="some-registry"`},
+		}))
+		server.RouteToHandler("HEAD", "/v2/some/image/manifests/latest", ghttp.CombineHandlers(
+			ghttp.VerifyHeaderKV("Authorization", "Bearer some-access-token"),
+			ghttp.RespondWith(http.StatusOK, "", http.Header{
+				"Docker-Content-Digest": {"sha256:c4c25c2cd70e3071f08cf124c4b5c656c061dd38247d166d97098d58eeea8aa6"},
+			}),
+		))
+
+		logger = lagertest.NewTestLogger("registry")
+
+		config = registry.Config{
+			Repository: server.Addr() + "/some/image",
+			Debug:      true,
+		}
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	resolve := func() {
+		client, err := registry.NewClient(logger, config)
+		Expect(err).ToNot(HaveOccurred())
+
+		_, err = client.ResolveDigest("latest")
+		Expect(err).ToNot(HaveOccurred())
+	}
+
+	debugLogs := func(message string) []map[string]any {
+		var data []map[string]any
+		for _, log := range logger.Logs() {
+			if log.Message == "registry.debug."+message {
+				data = append(data, log.Data)
+			}
+		}
+		return data
+	}
+
+	Context("with basic credentials for the token server", func() {
+		BeforeEach(func() {
+			config.Username = "some-user"
+			config.Password = "some-password"
+
+			server.RouteToHandler("GET", "/token", ghttp.CombineHandlers(
+				ghttp.VerifyBasicAuth("some-user", "some-password"),
+				ghttp.RespondWith(http.StatusOK, `{"token":"some-access-token"}`),
+			))
+		})
+
+		It("logs the requests, responses and challenges without the credentials", func() {
+			resolve()
+
+			Expect(debugLogs("request")).To(ContainElements(
+				And(
+					HaveKeyWithValue("method", "GET"),
+					HaveKeyWithValue("url", server.URL()+"/v2/"),
+				),
+				And(
+					HaveKeyWithValue("url", server.URL()+"/token?account=some-user&client_id=concourse-docker-image-resource&offline_token=%5BREDACTED%5D&scope=repository%3Asome%2Fimage%3Apull&service=some-registry"),
+					HaveKeyWithValue("authorization", "Basic [REDACTED]"),
+				),
+				And(
+					HaveKeyWithValue("method", "HEAD"),
+					HaveKeyWithValue("authorization", "Bearer [REDACTED]"),
+					HaveKey("accept"),
+				),
+			))
+
+			Expect(debugLogs("response")).To(ContainElements(
+				And(
+					HaveKeyWithValue("status", "401 Unauthorized"),
+					HaveKeyWithValue("challenges", ConsistOf(And(
+						HaveKeyWithValue("scheme", "bearer"),
+						HaveKeyWithValue("parameters", And(
+							HaveKeyWithValue("realm", server.URL()+"/token"),
+							HaveKeyWithValue("service", "some-registry"),
+						)),
+					))),
+				),
+				And(
+					HaveKeyWithValue("status", "200 OK"),
+					HaveKeyWithValue("docker-content-digest", "sha256:c4c25c2cd70e3071f08cf124c4b5c656c061dd38247d166d97098d58eeea8aa6"),
+				),
+			))
+
+			Expect(string(logger.Buffer().Contents())).ToNot(ContainSubstring("some-password"))
+			Expect(string(logger.Buffer().Contents())).ToNot(ContainSubstring("some-access-token"))
+		})
+	})
+
+	Context("when a blob is redirected to a pre-signed URL", func() {
+		var storage *ghttp.Server
+
+		presignedQuery := "X-Amz-Security-Token=some-security-token" +
+			"&X-Amz-Signature=some-amz-signature" +
+			"&X-Amz-Credential=some-amz-credential" +
+			"&X-Goog-Signature=some-goog-signature" +
+			"&sig=some-azure-sig" +
+			"&Client_Secret=some-client-secret" +
+			"&expires=3600"
+
+		BeforeEach(func() {
+			config.RegistryToken = "some-access-token"
+
+			storage = ghttp.NewServer()
+			storage.RouteToHandler("GET", "/some-blob", ghttp.RespondWith(http.StatusOK, "some-blob"))
+
+			server.RouteToHandler("GET", "/v2/some/image/blobs/"+string(digest.FromString("some-blob")), ghttp.RespondWith(http.StatusTemporaryRedirect, "", http.Header{
+				"Location": {storage.URL() + "/some-blob?" + presignedQuery},
+			}))
+		})
+
+		AfterEach(func() {
+			storage.Close()
+		})
+
+		It("logs the redirect without the pre-signed query values", func() {
+			client, err := registry.NewClient(logger, config)
+			Expect(err).ToNot(HaveOccurred())
+
+			blob, err := client.GetBlob(digest.FromString("some-blob"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(io.ReadAll(blob)).To(Equal([]byte("some-blob")))
+			blob.Close()
+
+			Expect(debugLogs("response")).To(ContainElement(And(
+				HaveKeyWithValue("status", "307 Temporary Redirect"),
+				HaveKeyWithValue("location", ContainSubstring("X-Amz-Signature=%5BREDACTED%5D")),
+			)))
+			Expect(debugLogs("request")).To(ContainElement(
+				HaveKeyWithValue("url", storage.URL()+"/some-blob?Client_Secret=%5BREDACTED%5D&X-Amz-Credential=%5BREDACTED%5D&X-Amz-Security-Token=%5BREDACTED%5D&X-Amz-Signature=%5BREDACTED%5D&X-Goog-Signature=%5BREDACTED%5D&expires=3600&sig=%5BREDACTED%5D"),
+			))
+
+			for _, value := range []string{
+				"some-security-token",
+				"some-amz-signature",
+				"some-amz-credential",
+				"some-goog-signature",
+				"some-azure-sig",
+				"some-client-secret",
+			} {
+				Expect(string(logger.Buffer().Contents())).ToNot(ContainSubstring(value))
+			}
+		})
+	})
+
+	Context("with an identity token", func() {
+		BeforeEach(func() {
+			config.IdentityToken = "some-identity-token"
+
+			server.RouteToHandler("POST", "/token", ghttp.RespondWith(http.StatusOK,
+				`{"access_token":"some-access-token","refresh_token":"some-refresh-token"}`,
+			))
+		})
+
+		It("logs the scopes requested from the token server without the tokens", func() {
+			resolve()
+
+			Expect(debugLogs("request")).To(ContainElement(And(
+				HaveKeyWithValue("method", "POST"),
+				HaveKeyWithValue("form", And(
+					HaveKeyWithValue("grant_type", "refresh_token"),
+					HaveKeyWithValue("scope", "repository:some/image:pull"),
+					HaveKeyWithValue("service", "some-registry"),
+				)),
+			)))
+
+			Expect(string(logger.Buffer().Contents())).ToNot(ContainSubstring("some-identity-token"))
+			Expect(string(logger.Buffer().Contents())).ToNot(ContainSubstring("some-refresh-token"))
+			Expect(string(logger.Buffer().Contents())).ToNot(ContainSubstring("some-access-token"))
+		})
+	})
+
+	It("logs nothing unless enabled", func() {
+		config.Debug = false
+		config.RegistryToken = "some-access-token"
+
+		resolve()
+
+		Expect(debugLogs("request")).To(BeEmpty())
+		Expect(debugLogs("response")).To(BeEmpty())
+	})
+})
@@ -0,0 +1,161 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	ecrapi "github.com/awslabs/amazon-ecr-credential-helper/ecr-login/api"
+)
+
+// awsRoleSessionName identifies the resource in CloudTrail when it assumes a
+// role.
+const awsRoleSessionName = "concourse-docker-image-resource"
+
+// ECRConfig forces the ECR credential path for the repository's registry,
+// e.g. one reached through a VPC endpoint or custom DNS whose hostname does
+// not identify it as ECR.
+type ECRConfig struct {
+	RegistryID string `json:"registry_id"`
+	Region     string `json:"region"`
+	Endpoint   string `json:"endpoint"`
+}
+
+// IsECR reports whether ECR credentials are needed for a registry host, i.e.
+// whether the host is a private ECR registry's, including its FIPS and
+// dual-stack endpoints, or is the repository's registry with source.ecr
+// configured.
+func (config Config) IsECR(host string) bool {
+	_, ok := config.ecrRegistry(host)
+	return ok
+}
+
+// ecrRegistry returns the ECR registry behind a registry host. The registry
+// ID and region configured in source.ecr take precedence over the ones in
+// the hostname.
+func (config Config) ecrRegistry(host string) (ecrapi.Registry, bool) {
+	var registry ecrapi.Registry
+
+	extracted, err := ecrapi.ExtractRegistry(host)
+	isECR := err == nil && extracted.Service == ecrapi.ServiceECR
+	if isECR {
+		registry = *extracted
+	}
+
+	if config.ECR == nil || !sameRegistryHost(host, config.Repository) {
+		return registry, isECR
+	}
+
+	registry.Service = ecrapi.ServiceECR
+	if config.ECR.RegistryID != "" {
+		registry.ID = config.ECR.RegistryID
+	}
+	if config.ECR.Region != "" {
+		registry.Region = config.ECR.Region
+	}
+
+	return registry, true
+}
+
+// ECRCredentials exchanges the configured AWS credentials, after assuming
+// the configured role if any, for a username and password for the ECR
+// repository. Without a registry ID, the credentials are for the default
+// registry of the AWS account.
+func ECRCredentials(config Config) (string, string, error) {
+	registry, ok := config.ecrRegistry(config.Repository)
+	if !ok {
+		return "", "", fmt.Errorf("%s is not an ECR repository", config.Repository)
+	}
+
+	awsConfig, err := loadAWSConfig(config, registry.Region, registry.FIPS)
+	if err != nil {
+		return "", "", err
+	}
+
+	if config.ECR != nil && config.ECR.Endpoint != "" {
+		// STS has already been set up with aws_endpoint, if any
+		awsConfig.BaseEndpoint = aws.String(config.ECR.Endpoint)
+	}
+
+	auth, err := ecrapi.DefaultClientFactory{}.NewClient(awsConfig).GetCredentialsByRegistryID(registry.ID)
+	if err != nil {
+		return "", "", err
+	}
+
+	return auth.Username, auth.Password, nil
+}
+
+// loadAWSConfig loads the AWS configuration the same way the AWS CLI would,
+// from the environment and instance metadata, unless static credentials are
+// configured. If a role is configured, it is assumed through STS with these
+// credentials or with a web identity token.
+func loadAWSConfig(config Config, region string, fips bool) (aws.Config, error) {
+	if config.AWSRegion != "" {
+		region = config.AWSRegion
+	}
+
+	opts := []func(*awsconfig.LoadOptions) error{
+		awsconfig.WithRegion(region),
+	}
+
+	if fips {
+		opts = append(opts, awsconfig.WithUseFIPSEndpoint(aws.FIPSEndpointStateEnabled))
+	}
+
+	if config.AWSAccessKeyID != "" {
+		opts = append(opts, awsconfig.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(
+			config.AWSAccessKeyID,
+			config.AWSSecretAccessKey,
+			config.AWSSessionToken,
+		)))
+	}
+
+	awsConfig, err := awsconfig.LoadDefaultConfig(context.TODO(), opts...)
+	if err != nil {
+		return aws.Config{}, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+
+	if config.AWSEndpoint != "" {
+		// unlike the WithBaseEndpoint option, this can still be overridden
+		// for ECR
+		awsConfig.BaseEndpoint = aws.String(config.AWSEndpoint)
+	}
+
+	if config.AWSRoleARN == "" {
+		return awsConfig, nil
+	}
+
+	stsClient := sts.NewFromConfig(awsConfig)
+
+	var provider aws.CredentialsProvider
+	if config.AWSWebIdentityTokenFile != "" {
+		if _, err := os.Stat(config.AWSWebIdentityTokenFile); err != nil {
+			return aws.Config{}, fmt.Errorf("failed to read web identity token: %w", err)
+		}
+
+		provider = stscreds.NewWebIdentityRoleProvider(
+			stsClient,
+			config.AWSRoleARN,
+			stscreds.IdentityTokenFile(config.AWSWebIdentityTokenFile),
+			func(o *stscreds.WebIdentityRoleOptions) {
+				o.RoleSessionName = awsRoleSessionName
+			},
+		)
+	} else {
+		provider = stscreds.NewAssumeRoleProvider(stsClient, config.AWSRoleARN, func(o *stscreds.AssumeRoleOptions) {
+			o.RoleSessionName = awsRoleSessionName
+			if config.AWSExternalID != "" {
+				o.ExternalID = aws.String(config.AWSExternalID)
+			}
+		})
+	}
+
+	awsConfig.Credentials = aws.NewCredentialsCache(provider)
+
+	return awsConfig, nil
+}
@@ -0,0 +1,254 @@
+package registry_test
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+
+	"github.com/concourse/docker-image-resource/registry"
+)
+
+const assumedCredentials = `<Credentials>
+  <AccessKeyId>ASIAASSUMED</AccessKeyId>
+  <SecretAccessKey>assumed-secret</SecretAccessKey>
+  <SessionToken>assumed-session-token</SessionToken>
+  <Expiration>2100-01-01T00:00:00Z</Expiration>
+</Credentials>`
+
+var _ = Describe("ECR credentials", func() {
+	var (
+		server *ghttp.Server
+		config registry.Config
+
+		stsRequests []*http.Request
+		ecrRequests []*http.Request
+		ecrBodies   []string
+
+		standIn http.HandlerFunc
+	)
+
+	BeforeEach(func() {
+		GinkgoT().Setenv("AWS_ECR_DISABLE_CACHE", "true")
+		GinkgoT().Setenv("AWS_CONFIG_FILE", filepath.Join(GinkgoT().TempDir(), "config"))
+		GinkgoT().Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(GinkgoT().TempDir(), "credentials"))
+		GinkgoT().Setenv("AWS_EC2_METADATA_DISABLED", "true")
+
+		stsRequests = nil
+		ecrRequests = nil
+		ecrBodies = nil
+
+		// a stand-in for both STS and ECR, which tell their requests apart
+		// by the X-Amz-Target header of ECR's JSON protocol
+		standIn = func(w http.ResponseWriter, r *http.Request) {
+			Expect(r.ParseForm()).To(Succeed())
+
+			if r.Header.Get("X-Amz-Target") == "AmazonEC2ContainerRegistry_V20150921.GetAuthorizationToken" {
+				body, err := io.ReadAll(r.Body)
+				Expect(err).ToNot(HaveOccurred())
+
+				ecrRequests = append(ecrRequests, r)
+				ecrBodies = append(ecrBodies, string(body))
+
+				w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+				fmt.Fprintf(w, `{"authorizationData":[{"authorizationToken":%q,"expiresAt":4102444800,"proxyEndpoint":"https://123456789012.dkr.ecr.eu-west-1.amazonaws.com"}]}`,
+					base64.StdEncoding.EncodeToString([]byte("AWS:some-ecr-password")))
+				return
+			}
+
+			stsRequests = append(stsRequests, r)
+
+			action := r.PostForm.Get("Action")
+			w.Header().Set("Content-Type", "text/xml")
+			fmt.Fprintf(w, `<%[1]sResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <%[1]sResult>
+    %[2]s
+    <AssumedRoleUser>
+      <Arn>arn:aws:sts::123456789012:assumed-role/some-role/concourse-docker-image-resource</Arn>
+      <AssumedRoleId>AROASOMEROLE:concourse-docker-image-resource</AssumedRoleId>
+    </AssumedRoleUser>
+  </%[1]sResult>
+</%[1]sResponse>`, action, assumedCredentials)
+		}
+
+		server = ghttp.NewServer()
+		server.RouteToHandler("POST", "/", standIn)
+
+		config = registry.Config{
+			Repository:         "123456789012.dkr.ecr.eu-west-1.amazonaws.com/some/image",
+			AWSAccessKeyID:     "AKIASTATIC",
+			AWSSecretAccessKey: "static-secret",
+			AWSEndpoint:        server.URL(),
+		}
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	signedWith := func(request *http.Request) string {
+		authorization := request.Header.Get("Authorization")
+		_, credential, _ := strings.Cut(authorization, "Credential=")
+		accessKeyID, _, _ := strings.Cut(credential, "/")
+		return accessKeyID
+	}
+
+	It("exchanges the static credentials for an ECR password", func() {
+		username, password, err := registry.ECRCredentials(config)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(username).To(Equal("AWS"))
+		Expect(password).To(Equal("some-ecr-password"))
+
+		Expect(stsRequests).To(BeEmpty())
+		Expect(ecrRequests).To(HaveLen(1))
+		Expect(signedWith(ecrRequests[0])).To(Equal("AKIASTATIC"))
+		Expect(ecrRequests[0].Header.Get("Authorization")).To(ContainSubstring("/eu-west-1/ecr/"))
+	})
+
+	It("uses the configured region", func() {
+		config.AWSRegion = "us-east-2"
+
+		_, _, err := registry.ECRCredentials(config)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ecrRequests[0].Header.Get("Authorization")).To(ContainSubstring("/us-east-2/ecr/"))
+	})
+
+	It("requests the password for the registry in the hostname", func() {
+		_, _, err := registry.ECRCredentials(config)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ecrBodies[0]).To(MatchJSON(`{"registryIds":["123456789012"]}`))
+	})
+
+	DescribeTable("recognizes ECR registries by their hostname",
+		func(host string, isECR bool) {
+			Expect(registry.Config{}.IsECR(host)).To(Equal(isECR))
+		},
+		Entry("standard", "123456789012.dkr.ecr.us-east-1.amazonaws.com", true),
+		Entry("with a path", "123456789012.dkr.ecr.us-east-1.amazonaws.com/some/image", true),
+		Entry("China", "123456789012.dkr.ecr.cn-north-1.amazonaws.com.cn", true),
+		Entry("FIPS", "123456789012.dkr.ecr-fips.us-gov-west-1.amazonaws.com", true),
+		Entry("dual-stack", "123456789012.dkr-ecr.us-east-1.on.aws", true),
+		Entry("dual-stack FIPS", "123456789012.dkr-ecr-fips.us-east-1.on.aws", true),
+		Entry("public", "public.ecr.aws", false),
+		Entry("other registries", "registry.corp.local", false),
+	)
+
+	Context("with source.ecr", func() {
+		var ecrServer *ghttp.Server
+
+		BeforeEach(func() {
+			ecrServer = ghttp.NewServer()
+			ecrServer.RouteToHandler("POST", "/", standIn)
+
+			config.Repository = "registry.corp.local/some/image"
+			config.AWSEndpoint = ""
+			config.ECR = &registry.ECRConfig{
+				RegistryID: "123456789012",
+				Region:     "eu-west-1",
+				Endpoint:   ecrServer.URL(),
+			}
+		})
+
+		AfterEach(func() {
+			ecrServer.Close()
+		})
+
+		It("fetches the password from the configured endpoint regardless of the hostname", func() {
+			Expect(config.IsECR("registry.corp.local")).To(BeTrue())
+			Expect(config.IsECR("other.corp.local")).To(BeFalse())
+
+			username, password, err := registry.ECRCredentials(config)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(username).To(Equal("AWS"))
+			Expect(password).To(Equal("some-ecr-password"))
+
+			Expect(ecrServer.ReceivedRequests()).To(HaveLen(1))
+			Expect(ecrBodies[0]).To(MatchJSON(`{"registryIds":["123456789012"]}`))
+			Expect(ecrRequests[0].Header.Get("Authorization")).To(ContainSubstring("/eu-west-1/ecr/"))
+		})
+
+		It("requests the password for the account's default registry without a registry ID", func() {
+			config.ECR.RegistryID = ""
+
+			_, _, err := registry.ECRCredentials(config)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ecrBodies[0]).To(MatchJSON(`{}`))
+		})
+
+		It("overrides the registry in the hostname", func() {
+			config.Repository = "123456789012.dkr.ecr.us-east-1.amazonaws.com/some/image"
+			config.ECR.RegistryID = "210987654321"
+
+			_, _, err := registry.ECRCredentials(config)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ecrBodies[0]).To(MatchJSON(`{"registryIds":["210987654321"]}`))
+			Expect(ecrRequests[0].Header.Get("Authorization")).To(ContainSubstring("/eu-west-1/ecr/"))
+		})
+
+		It("still assumes roles through aws_endpoint", func() {
+			config.AWSEndpoint = server.URL()
+			config.AWSRoleARN = "arn:aws:iam::123456789012:role/some-role"
+
+			_, _, err := registry.ECRCredentials(config)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(server.ReceivedRequests()).To(HaveLen(1))
+			Expect(ecrServer.ReceivedRequests()).To(HaveLen(1))
+			Expect(signedWith(ecrRequests[0])).To(Equal("ASIAASSUMED"))
+		})
+	})
+
+	Context("with a role", func() {
+		BeforeEach(func() {
+			config.AWSRoleARN = "arn:aws:iam::123456789012:role/some-role"
+			config.AWSExternalID = "some-external-id"
+		})
+
+		It("assumes the role before fetching the ECR password", func() {
+			_, password, err := registry.ECRCredentials(config)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(password).To(Equal("some-ecr-password"))
+
+			Expect(stsRequests).To(HaveLen(1))
+			Expect(stsRequests[0].PostForm.Get("Action")).To(Equal("AssumeRole"))
+			Expect(stsRequests[0].PostForm.Get("RoleArn")).To(Equal("arn:aws:iam::123456789012:role/some-role"))
+			Expect(stsRequests[0].PostForm.Get("ExternalId")).To(Equal("some-external-id"))
+			Expect(stsRequests[0].PostForm.Get("RoleSessionName")).To(Equal("concourse-docker-image-resource"))
+			Expect(signedWith(stsRequests[0])).To(Equal("AKIASTATIC"))
+
+			Expect(signedWith(ecrRequests[0])).To(Equal("ASIAASSUMED"))
+		})
+
+		It("assumes the role with a web identity token", func() {
+			tokenFile := filepath.Join(GinkgoT().TempDir(), "token")
+			Expect(os.WriteFile(tokenFile, []byte("some-web-identity-token"), 0600)).To(Succeed())
+
+			config.AWSAccessKeyID = ""
+			config.AWSSecretAccessKey = ""
+			config.AWSWebIdentityTokenFile = tokenFile
+
+			_, password, err := registry.ECRCredentials(config)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(password).To(Equal("some-ecr-password"))
+
+			Expect(stsRequests).To(HaveLen(1))
+			Expect(stsRequests[0].PostForm.Get("Action")).To(Equal("AssumeRoleWithWebIdentity"))
+			Expect(stsRequests[0].PostForm.Get("WebIdentityToken")).To(Equal("some-web-identity-token"))
+
+			Expect(signedWith(ecrRequests[0])).To(Equal("ASIAASSUMED"))
+		})
+
+		It("fails when the web identity token file is missing", func() {
+			config.AWSWebIdentityTokenFile = filepath.Join(GinkgoT().TempDir(), "missing")
+
+			_, _, err := registry.ECRCredentials(config)
+			Expect(err).To(MatchError(ContainSubstring("failed to read web identity token")))
+		})
+	})
+})
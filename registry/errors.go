@@ -0,0 +1,104 @@
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Error codes returned by registries, as defined by the distribution spec.
+const (
+	ErrorCodeUnauthorized    = "UNAUTHORIZED"
+	ErrorCodeDenied          = "DENIED"
+	ErrorCodeManifestUnknown = "MANIFEST_UNKNOWN"
+	ErrorCodeNameUnknown     = "NAME_UNKNOWN"
+	ErrorCodeBlobUnknown     = "BLOB_UNKNOWN"
+	ErrorCodeTooManyRequests = "TOOMANYREQUESTS"
+)
+
+// ErrNotFound is matched by errors returned for manifests, blobs or
+// repositories that do not exist in the registry.
+var ErrNotFound = errors.New("not found")
+
+// StatusError is returned when the registry responds with an unexpected
+// status code.
+type StatusError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Status     string
+
+	// Errors holds the errors reported in the response body, if any.
+	Errors []ErrorDetail
+}
+
+// ErrorDetail is an entry of the "errors" array returned by the registry.
+type ErrorDetail struct {
+	Code    string          `json:"code"`
+	Message string          `json:"message"`
+	Detail  json.RawMessage `json:"detail,omitempty"`
+}
+
+func (err *StatusError) Error() string {
+	message := fmt.Sprintf("%s %s: %s", err.Method, err.URL, err.Status)
+	for _, detail := range err.Errors {
+		message += fmt.Sprintf(": %s: %s", detail.Code, detail.Message)
+	}
+	return message
+}
+
+func (err *StatusError) Is(target error) bool {
+	return target == ErrNotFound && err.StatusCode == http.StatusNotFound
+}
+
+// Code returns the first error code reported by the registry, or "" if the
+// response did not include any.
+func (err *StatusError) Code() string {
+	if len(err.Errors) == 0 {
+		return ""
+	}
+
+	return err.Errors[0].Code
+}
+
+// PingError is returned when the registry cannot be reached over either
+// https or http.
+type PingError struct {
+	Host string
+	Err  error
+}
+
+func (err *PingError) Error() string {
+	return fmt.Sprintf("failed to ping registry: %s", err.Err)
+}
+
+func (err *PingError) Unwrap() error {
+	return err.Err
+}
+
+// maxErrorBody limits how much of an error response is read when looking
+// for error details.
+const maxErrorBody = 64 * 1024
+
+func newStatusError(response *http.Response) error {
+	statusErr := &StatusError{
+		Method:     response.Request.Method,
+		URL:        response.Request.URL.String(),
+		StatusCode: response.StatusCode,
+		Status:     response.Status,
+	}
+
+	body, err := io.ReadAll(io.LimitReader(response.Body, maxErrorBody))
+	if err == nil {
+		var errorResponse struct {
+			Errors []ErrorDetail `json:"errors"`
+		}
+		if json.Unmarshal(body, &errorResponse) == nil {
+			statusErr.Errors = errorResponse.Errors
+		}
+	}
+
+	return statusErr
+}
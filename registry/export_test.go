@@ -0,0 +1,6 @@
+package registry
+
+var (
+	HostMatches = hostMatches
+	IsInsecure  = isInsecure
+)
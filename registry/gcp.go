@@ -0,0 +1,143 @@
+package registry
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	gcpDefaultTokenURI = "https://oauth2.googleapis.com/token"
+	gcpScope           = "https://www.googleapis.com/auth/cloud-platform"
+
+	// gcpUsername is the username Artifact Registry and Container Registry
+	// expect alongside an access token.
+	gcpUsername = "oauth2accesstoken"
+)
+
+// GCPServiceAccountKey is the JSON key of a Google Cloud service account.
+// The access tokens are requested from its token_uri.
+type GCPServiceAccountKey struct {
+	ClientEmail  string `json:"client_email"`
+	PrivateKey   string `json:"private_key"`
+	PrivateKeyID string `json:"private_key_id"`
+	TokenURI     string `json:"token_uri"`
+}
+
+// UnmarshalJSON accepts the key either as an object or as a string
+// containing its JSON, as downloaded from Google Cloud.
+func (key *GCPServiceAccountKey) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		b = []byte(s)
+	}
+
+	type gcpServiceAccountKey GCPServiceAccountKey
+	var parsed gcpServiceAccountKey
+	if err := json.Unmarshal(b, &parsed); err != nil {
+		return fmt.Errorf("invalid gcp_service_account_key: %w", err)
+	}
+
+	*key = GCPServiceAccountKey(parsed)
+	return nil
+}
+
+// gcpCredentials exchanges a JWT signed with the service account's key for
+// an access token, as in OAuth2's JWT bearer grant.
+func gcpCredentials(client *http.Client, key GCPServiceAccountKey) (Credentials, error) {
+	tokenURI := key.TokenURI
+	if tokenURI == "" {
+		tokenURI = gcpDefaultTokenURI
+	}
+
+	assertion, err := key.assertion(tokenURI, time.Now())
+	if err != nil {
+		return Credentials{}, err
+	}
+
+	var response struct {
+		AccessToken string `json:"access_token"`
+	}
+
+	err = postTokenForm(client, tokenURI, url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	}, &response)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("failed to get GCP access token: %w", err)
+	}
+
+	return Credentials{Username: gcpUsername, Password: response.AccessToken}, nil
+}
+
+// assertion returns a JWT asserting the service account's identity to the
+// token endpoint, valid for an hour.
+func (key GCPServiceAccountKey) assertion(audience string, now time.Time) (string, error) {
+	privateKey, err := key.rsaKey()
+	if err != nil {
+		return "", err
+	}
+
+	header, err := json.Marshal(map[string]string{
+		"alg": "RS256",
+		"typ": "JWT",
+		"kid": key.PrivateKeyID,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	claims, err := json.Marshal(map[string]any{
+		"iss":   key.ClientEmail,
+		"scope": gcpScope,
+		"aud":   audience,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	hash := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, privateKey, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", fmt.Errorf("failed to sign GCP assertion: %w", err)
+	}
+
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func (key GCPServiceAccountKey) rsaKey() (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(key.PrivateKey))
+	if block == nil {
+		return nil, errors.New("gcp_service_account_key: private_key is not PEM encoded")
+	}
+
+	if parsed, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return parsed, nil
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("gcp_service_account_key: failed to parse private_key: %w", err)
+	}
+
+	rsaKey, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("gcp_service_account_key: private_key is not an RSA key")
+	}
+
+	return rsaKey, nil
+}
@@ -0,0 +1,138 @@
+package registry_test
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"strings"
+
+	"code.cloudfoundry.org/lager/v3/lagertest"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+
+	"github.com/concourse/docker-image-resource/registry"
+)
+
+var _ = Describe("GCP service account keys", func() {
+	var (
+		server     *ghttp.Server
+		privateKey *rsa.PrivateKey
+		config     registry.Config
+	)
+
+	BeforeEach(func() {
+		var err error
+		privateKey, err = rsa.GenerateKey(rand.Reader, 2048)
+		Expect(err).ToNot(HaveOccurred())
+
+		der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+		Expect(err).ToNot(HaveOccurred())
+
+		server = ghttp.NewServer()
+		server.RouteToHandler("GET", "/v2/", ghttp.RespondWith(http.StatusUnauthorized, "", http.Header{
+			"WWW-Authenticate": {`Basic realm="registry"`},
+		}))
+		server.RouteToHandler("POST", "/token", ghttp.CombineHandlers(
+			func(w http.ResponseWriter, r *http.Request) {
+				Expect(r.ParseForm()).To(Succeed())
+				Expect(r.PostForm.Get("grant_type")).To(Equal("urn:ietf:params:oauth:grant-type:jwt-bearer"))
+
+				parts := strings.Split(r.PostForm.Get("assertion"), ".")
+				Expect(parts).To(HaveLen(3))
+
+				signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+				Expect(err).ToNot(HaveOccurred())
+				hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+				Expect(rsa.VerifyPKCS1v15(&privateKey.PublicKey, crypto.SHA256, hash[:], signature)).To(Succeed())
+
+				header, err := base64.RawURLEncoding.DecodeString(parts[0])
+				Expect(err).ToNot(HaveOccurred())
+				Expect(header).To(MatchJSON(`{"alg":"RS256","typ":"JWT","kid":"some-key-id"}`))
+
+				rawClaims, err := base64.RawURLEncoding.DecodeString(parts[1])
+				Expect(err).ToNot(HaveOccurred())
+				var claims map[string]any
+				Expect(json.Unmarshal(rawClaims, &claims)).To(Succeed())
+				Expect(claims).To(HaveKeyWithValue("iss", "some-account@some-project.iam.gserviceaccount.com"))
+				Expect(claims).To(HaveKeyWithValue("aud", server.URL()+"/token"))
+				Expect(claims).To(HaveKeyWithValue("scope", "https://www.googleapis.com/auth/cloud-platform"))
+				Expect(claims["exp"].(float64) - claims["iat"].(float64)).To(Equal(3600.0))
+			},
+			ghttp.RespondWith(http.StatusOK, `{"access_token":"some-access-token","expires_in":3599,"token_type":"Bearer"}`),
+		))
+
+		key, err := json.Marshal(map[string]string{
+			"type":           "service_account",
+			"client_email":   "some-account@some-project.iam.gserviceaccount.com",
+			"private_key_id": "some-key-id",
+			"private_key":    string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+			"token_uri":      server.URL() + "/token",
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		// the key is given as the string downloaded from Google Cloud
+		source, err := json.Marshal(map[string]string{
+			"repository":              server.Addr() + "/some/image",
+			"gcp_service_account_key": string(key),
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		config = registry.Config{}
+		Expect(json.Unmarshal(source, &config)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("exchanges a signed assertion for an access token sent as the password", func() {
+		server.RouteToHandler("HEAD", "/v2/some/image/manifests/latest", ghttp.CombineHandlers(
+			ghttp.VerifyBasicAuth("oauth2accesstoken", "some-access-token"),
+			ghttp.RespondWith(http.StatusOK, "", http.Header{
+				"Docker-Content-Digest": {"sha256:c4c25c2cd70e3071f08cf124c4b5c656c061dd38247d166d97098d58eeea8aa6"},
+			}),
+		))
+
+		client, err := registry.NewClient(lagertest.NewTestLogger("registry"), config)
+		Expect(err).ToNot(HaveOccurred())
+
+		_, err = client.ResolveDigest("latest")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("returns the access token to log in with", func() {
+		username, password, err := registry.LoginCredentials(config)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(username).To(Equal("oauth2accesstoken"))
+		Expect(password).To(Equal("some-access-token"))
+	})
+
+	It("prefers the configured username and password", func() {
+		config.Username = "some-user"
+		config.Password = "some-password"
+
+		username, _, err := registry.LoginCredentials(config)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(username).To(Equal("some-user"))
+
+		for _, request := range server.ReceivedRequests() {
+			Expect(request.URL.Path).ToNot(Equal("/token"))
+		}
+	})
+
+	It("reports errors from the token endpoint", func() {
+		server.RouteToHandler("POST", "/token", ghttp.RespondWith(http.StatusBadRequest,
+			`{"error":"invalid_grant","error_description":"Invalid JWT Signature."}`,
+		))
+
+		_, _, err := registry.LoginCredentials(config)
+		Expect(err).To(MatchError(ContainSubstring("invalid_grant: Invalid JWT Signature.")))
+	})
+})
@@ -0,0 +1,279 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"code.cloudfoundry.org/lager/v3"
+	"github.com/distribution/reference"
+	v2 "github.com/docker/distribution/registry/api/v2"
+)
+
+// RegistryMirror is a mirror of a registry, with the credentials to
+// authenticate against it if it requires any. The path of its URL, if any, is
+// the namespace the mirror serves the registry's repositories under.
+type RegistryMirror struct {
+	URL      string `json:"url"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+
+	// upstream is the registry to name in the ns query parameter, if any
+	upstream string
+	// sourceCredentials is set for the legacy registry_mirror, which is
+	// authenticated against with the source's credentials when it has none
+	// of its own
+	sourceCredentials bool
+}
+
+// mirrorsFor returns the mirrors configured for a registry in the order they
+// are tried: the legacy registry_mirror and registry_mirrors for Docker Hub,
+// then registry_mirrors_by_host.
+func (config Config) mirrorsFor(registryHost string) []RegistryMirror {
+	var mirrors []RegistryMirror
+	if !hasExplicitlyDeclaredRegistryHost(registryHost) {
+		if config.RegistryMirror != "" {
+			mirrors = append(mirrors, RegistryMirror{URL: config.RegistryMirror, sourceCredentials: true})
+		}
+
+		mirrors = append(mirrors, config.RegistryMirrors...)
+	}
+
+	for _, host := range slices.Sorted(maps.Keys(config.RegistryMirrorsByHost)) {
+		if !sameRegistryHost(host, registryHost) {
+			continue
+		}
+
+		for _, mirror := range config.RegistryMirrorsByHost[host] {
+			mirror.upstream = upstreamName(registryHost)
+			mirrors = append(mirrors, mirror)
+		}
+	}
+
+	return mirrors
+}
+
+// upstreamName returns the name pull-through caches know a registry by.
+func upstreamName(registryHost string) string {
+	if sameRegistryHost(registryHost, officialRegistry) {
+		return "docker.io"
+	}
+
+	return registryHost
+}
+
+// newMirrorEndpoint returns the endpoint serving a repository of a registry
+// through one of its mirrors. Mirrors are not retried so that the next
+// endpoint is tried as soon as one fails.
+func newMirrorEndpoint(logger lager.Logger, config Config, mirror RegistryMirror, repository string) (*endpoint, error) {
+	mirrorURL, err := url.Parse(mirror.URL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse registry mirror URL: %w", err)
+	}
+
+	if prefix := strings.Trim(mirrorURL.Path, "/"); prefix != "" {
+		repository = prefix + "/" + repository
+	}
+
+	endpoint := newEndpoint(logger, mirror.config(config), mirrorURL.Host, repository, false)
+	endpoint.upstream = mirror.upstream
+
+	return endpoint, nil
+}
+
+// config returns the configuration to connect to the mirror with, which
+// takes the mirror's own credentials into account as if they were given in
+// additional_private_registries. The source's credentials belong to the
+// repository's registry, so they are only sent to the legacy
+// registry_mirror; other mirrors get only the credentials given for their
+// host.
+func (mirror RegistryMirror) config(config Config) Config {
+	if !mirror.sourceCredentials {
+		config.Username = ""
+		config.Password = ""
+		config.IdentityToken = ""
+		config.RegistryToken = ""
+	}
+
+	if mirror.Username == "" {
+		return config
+	}
+
+	config.AdditionalPrivateRegistries = append([]PrivateRegistry{{
+		Registry: mirror.URL,
+		Username: mirror.Username,
+		Password: mirror.Password,
+	}}, config.AdditionalPrivateRegistries...)
+
+	return config
+}
+
+// endpoint is a registry (or mirror) serving the repository. It is connected
+// to lazily, so that mirrors which are never needed are never contacted.
+type endpoint struct {
+	logger     lager.Logger
+	config     Config
+	host       string
+	repository string
+	retry      bool
+	upstream   string
+
+	name reference.Named
+	ub   *v2.URLBuilder
+	http *http.Client
+
+	connected  bool
+	connectErr error
+}
+
+func newEndpoint(logger lager.Logger, config Config, host string, repository string, retry bool) *endpoint {
+	return &endpoint{
+		logger:     logger,
+		config:     config,
+		host:       host,
+		repository: repository,
+		retry:      retry,
+	}
+}
+
+// connect pings the endpoint and sets up authentication against it. A
+// failure to connect is remembered.
+func (endpoint *endpoint) connect() error {
+	if endpoint.connected || endpoint.connectErr != nil {
+		return endpoint.connectErr
+	}
+
+	endpoint.connectErr = endpoint.setUp()
+	endpoint.connected = endpoint.connectErr == nil
+
+	return endpoint.connectErr
+}
+
+func (endpoint *endpoint) setUp() error {
+	transport, registryURL, err := makeTransport(endpoint.logger, endpoint.config, endpoint.host, endpoint.repository, endpoint.retry)
+	if err != nil {
+		return err
+	}
+
+	endpoint.ub, err = v2.NewURLBuilderFromString(registryURL, false)
+	if err != nil {
+		return fmt.Errorf("failed to construct registry URL builder: %w", err)
+	}
+
+	endpoint.name, err = reference.WithName(endpoint.repository)
+	if err != nil {
+		return fmt.Errorf("failed to construct named reference: %w", err)
+	}
+
+	if endpoint.upstream != "" {
+		transport = &namespaceRoundTripper{
+			host:     endpoint.host,
+			upstream: endpoint.upstream,
+			rt:       transport,
+		}
+	}
+
+	endpoint.http = &http.Client{
+		Transport: maybeRetry(endpoint.logger, endpoint.config, transport, endpoint.retry),
+	}
+
+	return nil
+}
+
+// namespaceRoundTripper adds the ns query parameter naming the upstream
+// registry to the requests to a mirror, which is how pull-through caches
+// serving several registries (and containerd) tell them apart.
+type namespaceRoundTripper struct {
+	host     string
+	upstream string
+	rt       http.RoundTripper
+}
+
+func (rt *namespaceRoundTripper) RoundTrip(request *http.Request) (*http.Response, error) {
+	if request.URL.Host != rt.host {
+		return rt.rt.RoundTrip(request)
+	}
+
+	request = request.Clone(request.Context())
+
+	query := request.URL.Query()
+	query.Set("ns", rt.upstream)
+	request.URL.RawQuery = query.Encode()
+
+	return rt.rt.RoundTrip(request)
+}
+
+// do sends a request to each endpoint in turn until one serves it. Mirrors
+// fall back to the next endpoint when they cannot be set up, cannot be
+// reached, do not have what was requested or fail; the registry's error is
+// returned as is.
+func (client *Client) do(request func(*endpoint) error) error {
+	var err error
+	for i, endpoint := range client.endpoints {
+		last := i == len(client.endpoints)-1
+
+		// whatever failed to set up an endpoint fails every request to it,
+		// so it is skipped, logging only the first failure
+		failedBefore := endpoint.connectErr != nil
+		if err = endpoint.connect(); err != nil {
+			if last {
+				return err
+			}
+
+			if !failedBefore {
+				client.fallBack(endpoint, err)
+			}
+			continue
+		}
+
+		err = request(endpoint)
+		if err == nil {
+			client.served(endpoint)
+			return nil
+		}
+
+		if last || !shouldFallBack(err) {
+			return err
+		}
+
+		client.fallBack(endpoint, err)
+	}
+
+	return err
+}
+
+// served logs the endpoint serving the requests whenever it changes, if
+// there is more than one.
+func (client *Client) served(endpoint *endpoint) {
+	if len(client.endpoints) == 1 || client.lastServed == endpoint {
+		return
+	}
+
+	client.lastServed = endpoint
+	client.logger.Info("served", lager.Data{"endpoint": endpoint.host})
+}
+
+func (client *Client) fallBack(endpoint *endpoint, err error) {
+	client.logger.Info("falling-back", lager.Data{
+		"endpoint": endpoint.host,
+		"error":    err.Error(),
+	})
+}
+
+// shouldFallBack reports whether an error of an endpoint warrants trying the
+// next one: connection failures, missing manifests or blobs, and server
+// errors.
+func shouldFallBack(err error) bool {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode == http.StatusNotFound || statusErr.StatusCode >= http.StatusInternalServerError
+	}
+
+	var pingErr *PingError
+	var urlErr *url.Error
+	return errors.As(err, &pingErr) || errors.As(err, &urlErr)
+}
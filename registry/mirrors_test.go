@@ -0,0 +1,248 @@
+package registry_test
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"code.cloudfoundry.org/lager/v3/lagertest"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+
+	"github.com/concourse/docker-image-resource/registry"
+)
+
+var _ = Describe("Registry mirrors", func() {
+	var (
+		firstMirror  *ghttp.Server
+		secondMirror *ghttp.Server
+		logger       *lagertest.TestLogger
+		config       registry.Config
+	)
+
+	BeforeEach(func() {
+		firstMirror = ghttp.NewServer()
+		firstMirror.RouteToHandler("GET", "/v2/", ghttp.RespondWith(http.StatusOK, "{}"))
+
+		secondMirror = ghttp.NewServer()
+		secondMirror.RouteToHandler("GET", "/v2/", ghttp.RespondWith(http.StatusUnauthorized, "", http.Header{
+			"WWW-Authenticate": {`Basic realm="mirror"`},
+		}))
+		secondMirror.RouteToHandler("HEAD", "/v2/library/ubuntu/manifests/latest", ghttp.CombineHandlers(
+			ghttp.VerifyBasicAuth("mirror-user", "mirror-password"),
+			ghttp.RespondWith(http.StatusOK, "", http.Header{
+				"Docker-Content-Digest": {"sha256:c4c25c2cd70e3071f08cf124c4b5c656c061dd38247d166d97098d58eeea8aa6"},
+			}),
+		))
+
+		logger = lagertest.NewTestLogger("registry")
+		config = registry.Config{
+			Repository: "ubuntu",
+			RegistryMirrors: []registry.RegistryMirror{
+				{URL: firstMirror.URL()},
+				{URL: secondMirror.URL(), Username: "mirror-user", Password: "mirror-password"},
+			},
+		}
+	})
+
+	AfterEach(func() {
+		firstMirror.Close()
+		secondMirror.Close()
+	})
+
+	resolve := func() (string, error) {
+		client, err := registry.NewClient(logger, config)
+		if err != nil {
+			return "", err
+		}
+
+		return client.ResolveDigest("latest")
+	}
+
+	DescribeTable("falling back to the next mirror",
+		func(status int) {
+			firstMirror.RouteToHandler("HEAD", "/v2/library/ubuntu/manifests/latest", ghttp.RespondWith(status, ""))
+
+			resolved, err := resolve()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resolved).To(Equal("sha256:c4c25c2cd70e3071f08cf124c4b5c656c061dd38247d166d97098d58eeea8aa6"))
+
+			Expect(logger.LogMessages()).To(ContainElements("registry.falling-back", "registry.served"))
+			Expect(logger.Logs()[len(logger.Logs())-1].Data).To(HaveKeyWithValue("endpoint", secondMirror.Addr()))
+		},
+		Entry("when the tag is missing", http.StatusNotFound),
+		Entry("when the mirror fails", http.StatusBadGateway),
+	)
+
+	It("falls back to the next mirror when a mirror cannot be reached", func() {
+		firstMirror.Close()
+
+		resolved, err := resolve()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(resolved).To(Equal("sha256:c4c25c2cd70e3071f08cf124c4b5c656c061dd38247d166d97098d58eeea8aa6"))
+	})
+
+	It("does not contact the next mirror when the first one serves the request", func() {
+		firstMirror.RouteToHandler("HEAD", "/v2/library/ubuntu/manifests/latest", ghttp.RespondWith(http.StatusOK, "", http.Header{
+			"Docker-Content-Digest": {"sha256:c4c25c2cd70e3071f08cf124c4b5c656c061dd38247d166d97098d58eeea8aa6"},
+		}))
+
+		_, err := resolve()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(secondMirror.ReceivedRequests()).To(BeEmpty())
+	})
+
+	It("does not fall back on other errors", func() {
+		firstMirror.RouteToHandler("HEAD", "/v2/library/ubuntu/manifests/latest", ghttp.RespondWith(http.StatusForbidden, ""))
+
+		_, err := resolve()
+		Expect(err).To(HaveOccurred())
+		Expect(secondMirror.ReceivedRequests()).To(BeEmpty())
+	})
+})
+
+var _ = Describe("Registry mirrors by host", func() {
+	var (
+		upstream *ghttp.Server
+		mirror   *ghttp.Server
+		config   registry.Config
+	)
+
+	BeforeEach(func() {
+		upstream = ghttp.NewServer()
+		upstream.RouteToHandler("GET", "/v2/", ghttp.RespondWith(http.StatusOK, "{}"))
+
+		mirror = ghttp.NewServer()
+		mirror.RouteToHandler("GET", "/v2/", ghttp.RespondWith(http.StatusOK, "{}"))
+
+		config = registry.Config{
+			Repository: upstream.Addr() + "/some/image",
+			RegistryMirrorsByHost: map[string][]registry.RegistryMirror{
+				upstream.Addr(): {{URL: mirror.URL() + "/cache"}},
+			},
+		}
+	})
+
+	AfterEach(func() {
+		upstream.Close()
+		mirror.Close()
+	})
+
+	resolve := func() (string, error) {
+		client, err := registry.NewClient(lagertest.NewTestLogger("registry"), config)
+		if err != nil {
+			return "", err
+		}
+
+		return client.ResolveDigest("latest")
+	}
+
+	It("requests the repository under the mirror's path, naming the upstream registry", func() {
+		mirror.RouteToHandler("HEAD", "/v2/cache/some/image/manifests/latest", ghttp.CombineHandlers(
+			ghttp.VerifyRequest("HEAD", "/v2/cache/some/image/manifests/latest", "ns="+upstream.Addr()),
+			ghttp.RespondWith(http.StatusOK, "", http.Header{
+				"Docker-Content-Digest": {"sha256:c4c25c2cd70e3071f08cf124c4b5c656c061dd38247d166d97098d58eeea8aa6"},
+			}),
+		))
+
+		resolved, err := resolve()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(resolved).To(Equal("sha256:c4c25c2cd70e3071f08cf124c4b5c656c061dd38247d166d97098d58eeea8aa6"))
+		Expect(upstream.ReceivedRequests()).To(BeEmpty())
+	})
+
+	It("falls back to the upstream registry", func() {
+		mirror.RouteToHandler("HEAD", "/v2/cache/some/image/manifests/latest", ghttp.RespondWith(http.StatusNotFound, ""))
+		upstream.RouteToHandler("HEAD", "/v2/some/image/manifests/latest", ghttp.CombineHandlers(
+			ghttp.VerifyRequest("HEAD", "/v2/some/image/manifests/latest", ""),
+			ghttp.RespondWith(http.StatusOK, "", http.Header{
+				"Docker-Content-Digest": {"sha256:c4c25c2cd70e3071f08cf124c4b5c656c061dd38247d166d97098d58eeea8aa6"},
+			}),
+		))
+
+		resolved, err := resolve()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(resolved).To(Equal("sha256:c4c25c2cd70e3071f08cf124c4b5c656c061dd38247d166d97098d58eeea8aa6"))
+	})
+
+	It("does not send the source's credentials to the mirror", func() {
+		config.Username = "upstream-user"
+		config.Password = "upstream-password"
+
+		mirror.RouteToHandler("GET", "/v2/", ghttp.RespondWith(http.StatusUnauthorized, "", http.Header{
+			"WWW-Authenticate": {`Bearer realm="` + mirror.URL() + `/token",service="mirror"`},
+		}))
+		mirror.RouteToHandler("GET", "/token", ghttp.RespondWith(http.StatusOK, `{"token":"anonymous-token"}`))
+		mirror.RouteToHandler("HEAD", "/v2/cache/some/image/manifests/latest", ghttp.CombineHandlers(
+			ghttp.VerifyHeaderKV("Authorization", "Bearer anonymous-token"),
+			ghttp.RespondWith(http.StatusOK, "", http.Header{
+				"Docker-Content-Digest": {"sha256:c4c25c2cd70e3071f08cf124c4b5c656c061dd38247d166d97098d58eeea8aa6"},
+			}),
+		))
+
+		_, err := resolve()
+		Expect(err).ToNot(HaveOccurred())
+
+		for _, request := range mirror.ReceivedRequests() {
+			if request.URL.Path == "/token" {
+				Expect(request.Header.Get("Authorization")).To(BeEmpty())
+			}
+		}
+		Expect(upstream.ReceivedRequests()).To(BeEmpty())
+	})
+
+	It("sends the credentials of additional_private_registries for the mirror's host", func() {
+		config.Username = "upstream-user"
+		config.Password = "upstream-password"
+		config.AdditionalPrivateRegistries = []registry.PrivateRegistry{
+			{Registry: mirror.Addr(), Username: "mirror-user", Password: "mirror-password"},
+		}
+
+		mirror.RouteToHandler("GET", "/v2/", ghttp.RespondWith(http.StatusUnauthorized, "", http.Header{
+			"WWW-Authenticate": {`Basic realm="mirror"`},
+		}))
+		mirror.RouteToHandler("HEAD", "/v2/cache/some/image/manifests/latest", ghttp.CombineHandlers(
+			ghttp.VerifyBasicAuth("mirror-user", "mirror-password"),
+			ghttp.RespondWith(http.StatusOK, "", http.Header{
+				"Docker-Content-Digest": {"sha256:c4c25c2cd70e3071f08cf124c4b5c656c061dd38247d166d97098d58eeea8aa6"},
+			}),
+		))
+
+		_, err := resolve()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(upstream.ReceivedRequests()).To(BeEmpty())
+	})
+
+	It("falls back to the upstream registry for every request when a mirror cannot be set up", func() {
+		var dockerConfig registry.DockerConfig
+		Expect(json.Unmarshal([]byte(`{"credHelpers":{"`+mirror.Addr()+`":"missing"}}`), &dockerConfig)).To(Succeed())
+		config.DockerConfig = &dockerConfig
+
+		upstream.RouteToHandler("HEAD", "/v2/some/image/manifests/latest", ghttp.RespondWith(http.StatusOK, "", http.Header{
+			"Docker-Content-Digest": {"sha256:c4c25c2cd70e3071f08cf124c4b5c656c061dd38247d166d97098d58eeea8aa6"},
+		}))
+
+		client, err := registry.NewClient(lagertest.NewTestLogger("registry"), config)
+		Expect(err).ToNot(HaveOccurred())
+
+		for range 2 {
+			resolved, err := client.ResolveDigest("latest")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resolved).To(Equal("sha256:c4c25c2cd70e3071f08cf124c4b5c656c061dd38247d166d97098d58eeea8aa6"))
+		}
+	})
+
+	It("ignores mirrors of other registries", func() {
+		config.RegistryMirrorsByHost = map[string][]registry.RegistryMirror{
+			"ghcr.io": {{URL: mirror.URL()}},
+		}
+
+		upstream.RouteToHandler("HEAD", "/v2/some/image/manifests/latest", ghttp.RespondWith(http.StatusOK, "", http.Header{
+			"Docker-Content-Digest": {"sha256:c4c25c2cd70e3071f08cf124c4b5c656c061dd38247d166d97098d58eeea8aa6"},
+		}))
+
+		_, err := resolve()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(mirror.ReceivedRequests()).To(BeEmpty())
+	})
+})
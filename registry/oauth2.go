@@ -0,0 +1,57 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// oauth2Error is the body of a failed OAuth2 token request.
+type oauth2Error struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// newTokenClient returns the client with which credentials are exchanged
+// for tokens, trusting the same certificates as the registry's transport.
+func newTokenClient(config Config) (*http.Client, error) {
+	transport, err := newHostTransport(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   config.requestTimeout(defaultPingTimeout),
+	}, nil
+}
+
+// postTokenForm posts a form to an OAuth2 style token endpoint and decodes
+// its JSON response.
+func postTokenForm(client *http.Client, endpoint string, form url.Values, response any) error {
+	resp, err := client.Post(endpoint, "application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var failure oauth2Error
+		if json.NewDecoder(resp.Body).Decode(&failure) == nil && failure.Error != "" {
+			if failure.ErrorDescription != "" {
+				return fmt.Errorf("%s: %s: %s", endpoint, failure.Error, failure.ErrorDescription)
+			}
+			return fmt.Errorf("%s: %s", endpoint, failure.Error)
+		}
+
+		return fmt.Errorf("%s: unexpected status %s", endpoint, resp.Status)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(response); err != nil {
+		return fmt.Errorf("%s: invalid response: %w", endpoint, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,66 @@
+package registry
+
+import (
+	"runtime"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	MediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+)
+
+// Platform selects a manifest from a multi-arch image.
+type Platform struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+	Variant      string `json:"variant"`
+}
+
+// withDefaults fills in the OS and architecture the platform leaves out, so
+// that a partial platform such as {architecture: arm64} selects linux/arm64.
+func (platform Platform) withDefaults() Platform {
+	if platform.OS == "" {
+		platform.OS = "linux"
+	}
+	if platform.Architecture == "" {
+		platform.Architecture = runtime.GOARCH
+	}
+	return platform
+}
+
+func (platform Platform) String() string {
+	platform = platform.withDefaults()
+
+	s := platform.OS + "/" + platform.Architecture
+	if platform.Variant != "" {
+		s += "/" + platform.Variant
+	}
+	return s
+}
+
+// SelectManifest returns the first manifest matching the platform. A platform
+// without a variant matches manifests of any variant; one without an OS or
+// architecture matches linux or the runtime's architecture.
+func (platform Platform) SelectManifest(manifests []ocispec.Descriptor) (ocispec.Descriptor, bool) {
+	platform = platform.withDefaults()
+
+	for _, manifest := range manifests {
+		if manifest.Platform == nil {
+			continue
+		}
+
+		if manifest.Platform.OS != platform.OS || manifest.Platform.Architecture != platform.Architecture {
+			continue
+		}
+
+		if platform.Variant != "" && manifest.Platform.Variant != platform.Variant {
+			continue
+		}
+
+		return manifest, true
+	}
+
+	return ocispec.Descriptor{}, false
+}
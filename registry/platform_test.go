@@ -0,0 +1,66 @@
+package registry_test
+
+import (
+	"runtime"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/concourse/docker-image-resource/registry"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var _ = Describe("Platform", func() {
+	manifests := []ocispec.Descriptor{
+		{Digest: "sha256:attestation"},
+		{Digest: "sha256:amd64", Platform: &ocispec.Platform{OS: "linux", Architecture: "amd64"}},
+		{Digest: "sha256:armv6", Platform: &ocispec.Platform{OS: "linux", Architecture: "arm", Variant: "v6"}},
+		{Digest: "sha256:armv7", Platform: &ocispec.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}},
+	}
+
+	It("selects the manifest matching the os and architecture", func() {
+		manifest, found := registry.Platform{OS: "linux", Architecture: "amd64"}.SelectManifest(manifests)
+		Expect(found).To(BeTrue())
+		Expect(string(manifest.Digest)).To(Equal("sha256:amd64"))
+	})
+
+	It("selects the manifest matching the variant", func() {
+		manifest, found := registry.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}.SelectManifest(manifests)
+		Expect(found).To(BeTrue())
+		Expect(string(manifest.Digest)).To(Equal("sha256:armv7"))
+	})
+
+	It("selects the first variant when none is given", func() {
+		manifest, found := registry.Platform{OS: "linux", Architecture: "arm"}.SelectManifest(manifests)
+		Expect(found).To(BeTrue())
+		Expect(string(manifest.Digest)).To(Equal("sha256:armv6"))
+	})
+
+	It("defaults the os to linux", func() {
+		manifest, found := registry.Platform{Architecture: "arm", Variant: "v7"}.SelectManifest(manifests)
+		Expect(found).To(BeTrue())
+		Expect(string(manifest.Digest)).To(Equal("sha256:armv7"))
+	})
+
+	It("defaults the architecture to the runtime's", func() {
+		manifests := []ocispec.Descriptor{
+			{Digest: "sha256:other", Platform: &ocispec.Platform{OS: "linux", Architecture: "other"}},
+			{Digest: "sha256:runtime", Platform: &ocispec.Platform{OS: "linux", Architecture: runtime.GOARCH}},
+		}
+
+		manifest, found := registry.Platform{OS: "linux"}.SelectManifest(manifests)
+		Expect(found).To(BeTrue())
+		Expect(string(manifest.Digest)).To(Equal("sha256:runtime"))
+	})
+
+	It("does not find a missing platform", func() {
+		_, found := registry.Platform{OS: "linux", Architecture: "s390x"}.SelectManifest(manifests)
+		Expect(found).To(BeFalse())
+	})
+
+	It("formats as os/architecture/variant", func() {
+		Expect(registry.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}.String()).To(Equal("linux/arm64/v8"))
+		Expect(registry.Platform{OS: "linux", Architecture: "amd64"}.String()).To(Equal("linux/amd64"))
+		Expect(registry.Platform{Architecture: "arm64"}.String()).To(Equal("linux/arm64"))
+	})
+})
@@ -0,0 +1,155 @@
+package registry
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager/v3"
+)
+
+// defaultRateLimitWait is how long to wait in total for a rate limited
+// request when source.rate_limit_wait is not configured.
+const defaultRateLimitWait = time.Minute
+
+const (
+	// maxRateLimitAttempts bounds the attempts at a rate limited request,
+	// however short the waits the registry asks for.
+	maxRateLimitAttempts = 10
+	// minRateLimitWait is the shortest wait between attempts, as an HTTP date
+	// may be less than a second away.
+	minRateLimitWait = time.Second
+)
+
+// rateLimitRoundTripper logs the remaining pull quota reported by the
+// registry and waits for the duration given by Retry-After when a request is
+// rate limited, as long as the total wait stays within maxWait.
+type rateLimitRoundTripper struct {
+	logger  lager.Logger
+	maxWait time.Duration
+	rt      http.RoundTripper
+
+	lastRemaining string
+	lock          sync.Mutex
+}
+
+func newRateLimitRoundTripper(logger lager.Logger, config Config, rt http.RoundTripper) *rateLimitRoundTripper {
+	maxWait := defaultRateLimitWait
+	if config.RateLimitWait != nil {
+		maxWait = time.Duration(*config.RateLimitWait)
+	}
+
+	// the registry is waited on no longer than for a response
+	if config.Timeout != nil {
+		maxWait = min(maxWait, time.Duration(*config.Timeout))
+	}
+
+	return &rateLimitRoundTripper{
+		logger:  logger.Session("rate-limit"),
+		maxWait: maxWait,
+		rt:      rt,
+	}
+}
+
+func (rt *rateLimitRoundTripper) RoundTrip(request *http.Request) (*http.Response, error) {
+	var waited time.Duration
+	for attempt := 1; ; attempt++ {
+		response, err := rt.rt.RoundTrip(request)
+		if err != nil {
+			return nil, err
+		}
+
+		rt.logQuota(response)
+
+		if response.StatusCode != http.StatusTooManyRequests || !isIdempotent(request) || attempt >= maxRateLimitAttempts {
+			return response, nil
+		}
+
+		// a wait which has already passed is left to the retry policy
+		wait, ok := retryAfter(response.Header.Get("Retry-After"), time.Now())
+		if !ok {
+			return response, nil
+		}
+
+		wait = max(wait, minRateLimitWait)
+		if waited+wait > rt.maxWait {
+			return response, nil
+		}
+
+		rt.logger.Info("waiting", lager.Data{
+			"url":         request.URL.String(),
+			"retry-after": wait.String(),
+		})
+
+		response.Body.Close()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-request.Context().Done():
+			timer.Stop()
+			return nil, request.Context().Err()
+		}
+
+		waited += wait
+	}
+}
+
+// logQuota logs the remaining quota whenever it changes.
+func (rt *rateLimitRoundTripper) logQuota(response *http.Response) {
+	remaining := response.Header.Get("RateLimit-Remaining")
+	if remaining == "" {
+		return
+	}
+
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+
+	if remaining == rt.lastRemaining {
+		return
+	}
+	rt.lastRemaining = remaining
+
+	rt.logger.Info("quota", lager.Data{
+		"limit":     quotaValue(response.Header.Get("RateLimit-Limit")),
+		"remaining": quotaValue(remaining),
+		"source":    response.Header.Get("Docker-RateLimit-Source"),
+	})
+}
+
+// quotaValue strips the policy from a quota header such as "100;w=21600".
+func quotaValue(header string) string {
+	value, _, _ := strings.Cut(header, ";")
+	return strings.TrimSpace(value)
+}
+
+// retryAfter parses a Retry-After header, which is either a number of
+// seconds or an HTTP date. A wait which is not positive is not usable.
+func retryAfter(header string, now time.Time) (time.Duration, bool) {
+	if header == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(header); err == nil {
+		if seconds <= 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if date, err := http.ParseTime(header); err == nil {
+		wait := date.Sub(now)
+		if wait <= 0 {
+			return 0, false
+		}
+		return wait, true
+	}
+
+	return 0, false
+}
+
+func isIdempotent(request *http.Request) bool {
+	return request.Method == http.MethodGet || request.Method == http.MethodHead
+}
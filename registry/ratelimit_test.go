@@ -0,0 +1,182 @@
+package registry_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"code.cloudfoundry.org/lager/v3"
+	"code.cloudfoundry.org/lager/v3/lagertest"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+
+	"github.com/concourse/docker-image-resource/registry"
+)
+
+var _ = Describe("Rate limiting", func() {
+	var (
+		server *ghttp.Server
+		logger *lagertest.TestLogger
+		config registry.Config
+		client *registry.Client
+	)
+
+	BeforeEach(func() {
+		server = ghttp.NewServer()
+		server.RouteToHandler("GET", "/v2/", ghttp.RespondWith(http.StatusOK, "{}"))
+
+		logger = lagertest.NewTestLogger("registry")
+		interval := registry.Duration(time.Millisecond)
+		config = registry.Config{
+			Repository: server.Addr() + "/some/image",
+			Retry: &registry.RetryPolicy{
+				MaxAttempts:     2,
+				InitialInterval: &interval,
+			},
+		}
+	})
+
+	JustBeforeEach(func() {
+		var err error
+		client, err = registry.NewClient(logger, config)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("logs the remaining quota", func() {
+		server.RouteToHandler("HEAD", "/v2/some/image/manifests/latest", ghttp.RespondWith(http.StatusOK, "", http.Header{
+			"Docker-Content-Digest": {"sha256:c4c25c2cd70e3071f08cf124c4b5c656c061dd38247d166d97098d58eeea8aa6"},
+			"Ratelimit-Limit":       {"100;w=21600"},
+			"Ratelimit-Remaining":   {"76;w=21600"},
+		}))
+
+		_, err := client.ResolveDigest("latest")
+		Expect(err).ToNot(HaveOccurred())
+
+		logs := logger.LogMessages()
+		Expect(logs).To(ContainElement("registry.rate-limit.quota"))
+
+		for _, log := range logger.Logs() {
+			if log.Message == "registry.rate-limit.quota" {
+				Expect(log.LogLevel).To(Equal(lager.INFO))
+				Expect(log.Data).To(HaveKeyWithValue("limit", "100"))
+				Expect(log.Data).To(HaveKeyWithValue("remaining", "76"))
+			}
+		}
+	})
+
+	It("retries after the duration given by Retry-After", func() {
+		server.AppendHandlers(
+			ghttp.CombineHandlers(
+				ghttp.VerifyRequest("HEAD", "/v2/some/image/manifests/latest"),
+				ghttp.RespondWith(http.StatusTooManyRequests, "", http.Header{
+					"Retry-After": {"1"},
+				}),
+			),
+			ghttp.CombineHandlers(
+				ghttp.VerifyRequest("HEAD", "/v2/some/image/manifests/latest"),
+				ghttp.RespondWith(http.StatusOK, "", http.Header{
+					"Docker-Content-Digest": {"sha256:c4c25c2cd70e3071f08cf124c4b5c656c061dd38247d166d97098d58eeea8aa6"},
+				}),
+			),
+		)
+
+		start := time.Now()
+		resolved, err := client.ResolveDigest("latest")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(resolved).To(Equal("sha256:c4c25c2cd70e3071f08cf124c4b5c656c061dd38247d166d97098d58eeea8aa6"))
+		Expect(time.Since(start)).To(BeNumerically(">=", time.Second))
+		Expect(logger.LogMessages()).To(ContainElement("registry.rate-limit.waiting"))
+	})
+
+	DescribeTable("when Retry-After has already passed",
+		func(header func() string) {
+			server.RouteToHandler("HEAD", "/v2/some/image/manifests/latest", ghttp.RespondWith(http.StatusTooManyRequests, "", http.Header{
+				"Retry-After": {header()},
+			}))
+
+			_, err := client.ResolveDigest("latest")
+
+			var statusErr *registry.StatusError
+			Expect(errors.As(err, &statusErr)).To(BeTrue(), "%v", err)
+			Expect(statusErr.StatusCode).To(Equal(http.StatusTooManyRequests))
+
+			// the ping, then the attempts allowed by the retry policy
+			Expect(server.ReceivedRequests()).To(HaveLen(3))
+			Expect(logger.LogMessages()).ToNot(ContainElement("registry.rate-limit.waiting"))
+		},
+		Entry("as zero seconds", func() string { return "0" }),
+		Entry("as a date in the past", func() string { return time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat) }),
+	)
+
+	Context("when Retry-After exceeds timeout", func() {
+		BeforeEach(func() {
+			timeout := registry.Duration(500 * time.Millisecond)
+			config.Timeout = &timeout
+		})
+
+		It("returns the rate limit error without waiting", func() {
+			server.RouteToHandler("HEAD", "/v2/some/image/manifests/latest", ghttp.RespondWith(http.StatusTooManyRequests, "", http.Header{
+				"Retry-After": {"30"},
+			}))
+
+			start := time.Now()
+			_, err := client.ResolveDigest("latest")
+			Expect(err).To(HaveOccurred())
+			Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+			Expect(logger.LogMessages()).ToNot(ContainElement("registry.rate-limit.waiting"))
+		})
+	})
+
+	Context("when Retry-After exceeds rate_limit_wait", func() {
+		BeforeEach(func() {
+			wait := registry.Duration(time.Second)
+			config.RateLimitWait = &wait
+		})
+
+		It("returns the rate limit error without waiting", func() {
+			server.AppendHandlers(
+				ghttp.RespondWith(http.StatusTooManyRequests,
+					`{"errors":[{"code":"TOOMANYREQUESTS","message":"You have reached your pull rate limit."}]}`,
+					http.Header{
+						"Content-Type": {"application/json"},
+						"Retry-After":  {"3600"},
+					},
+				),
+			)
+
+			start := time.Now()
+			_, err := client.GetManifest("latest")
+			Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+
+			var statusErr *registry.StatusError
+			Expect(errors.As(err, &statusErr)).To(BeTrue())
+			Expect(statusErr.Code()).To(Equal(registry.ErrorCodeTooManyRequests))
+			Expect(server.ReceivedRequests()).To(HaveLen(2))
+		})
+	})
+})
+
+var _ = Describe("Duration", func() {
+	DescribeTable("unmarshaling",
+		func(value string, expected time.Duration) {
+			var duration registry.Duration
+			Expect(json.Unmarshal([]byte(value), &duration)).To(Succeed())
+			Expect(time.Duration(duration)).To(Equal(expected))
+		},
+		Entry("a number of seconds", `90`, 90*time.Second),
+		Entry("a fractional number of seconds", `1.5`, 1500*time.Millisecond),
+		Entry("a duration string", `"2m30s"`, 150*time.Second),
+	)
+
+	It("rejects invalid durations", func() {
+		var duration registry.Duration
+		Expect(json.Unmarshal([]byte(`"soon"`), &duration)).ToNot(Succeed())
+		Expect(json.Unmarshal([]byte(`true`), &duration)).ToNot(Succeed())
+	})
+})
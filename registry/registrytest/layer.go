@@ -0,0 +1,115 @@
+package registrytest
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+
+	"github.com/klauspost/compress/zstd"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// File is an entry of a layer. Regular files default to mode 0644 and
+// directories to 0755, and the size of regular files is that of their body.
+type File struct {
+	tar.Header
+	Body string
+}
+
+// RegularFile returns a regular file with the given content.
+func RegularFile(name string, body string) File {
+	return File{Header: tar.Header{Name: name, Typeflag: tar.TypeReg}, Body: body}
+}
+
+// Dir returns a directory.
+func Dir(name string) File {
+	return File{Header: tar.Header{Name: name, Typeflag: tar.TypeDir}}
+}
+
+// Layer is a layer blob along with the digest of its uncompressed content.
+type Layer struct {
+	MediaType string
+	Blob      []byte
+	DiffID    digest.Digest
+}
+
+// Tar archives files in the given order.
+func Tar(files ...File) []byte {
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+
+	for _, file := range files {
+		header := file.Header
+		if header.Typeflag == tar.TypeReg {
+			header.Size = int64(len(file.Body))
+		}
+
+		if header.Mode == 0 {
+			header.Mode = 0644
+			if header.Typeflag == tar.TypeDir {
+				header.Mode = 0755
+			}
+		}
+
+		if err := tw.WriteHeader(&header); err != nil {
+			panic(err)
+		}
+
+		if _, err := tw.Write([]byte(file.Body)); err != nil {
+			panic(err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		panic(err)
+	}
+
+	return buf.Bytes()
+}
+
+// UncompressedLayer returns a layer which is a plain tar of the files.
+func UncompressedLayer(files ...File) Layer {
+	archive := Tar(files...)
+
+	return Layer{
+		MediaType: ocispec.MediaTypeImageLayer,
+		Blob:      archive,
+		DiffID:    digest.FromBytes(archive),
+	}
+}
+
+// GzipLayer returns a layer which is a gzipped tar of the files.
+func GzipLayer(files ...File) Layer {
+	archive := Tar(files...)
+
+	buf := new(bytes.Buffer)
+	gw := gzip.NewWriter(buf)
+	gw.Write(archive)
+	if err := gw.Close(); err != nil {
+		panic(err)
+	}
+
+	return Layer{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Blob:      buf.Bytes(),
+		DiffID:    digest.FromBytes(archive),
+	}
+}
+
+// ZstdLayer returns a layer which is a zstd-compressed tar of the files.
+func ZstdLayer(files ...File) Layer {
+	archive := Tar(files...)
+
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		panic(err)
+	}
+	defer encoder.Close()
+
+	return Layer{
+		MediaType: ocispec.MediaTypeImageLayerZstd,
+		Blob:      encoder.EncodeAll(archive, nil),
+		DiffID:    digest.FromBytes(archive),
+	}
+}
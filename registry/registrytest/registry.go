@@ -0,0 +1,280 @@
+// Package registrytest provides an in-process Docker registry for testing
+// code which pulls images, along with helpers to build the images it serves.
+package registrytest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Registry serves blobs and manifests from memory over the registry's v2
+// API. Blobs are shared by all repositories.
+type Registry struct {
+	server *httptest.Server
+
+	blobs     map[digest.Digest][]byte
+	manifests map[string]map[string]manifest
+	lock      sync.Mutex
+}
+
+type manifest struct {
+	mediaType string
+	body      []byte
+}
+
+// New starts a registry, which must be closed once done with.
+func New() *Registry {
+	registry := &Registry{
+		blobs:     map[digest.Digest][]byte{},
+		manifests: map[string]map[string]manifest{},
+	}
+
+	registry.server = httptest.NewServer(http.HandlerFunc(registry.serve))
+
+	return registry
+}
+
+// Close shuts the registry down.
+func (registry *Registry) Close() {
+	registry.server.Close()
+}
+
+// Host returns the host and port the registry listens on, which is what
+// repositories served by it are prefixed with.
+func (registry *Registry) Host() string {
+	u, _ := url.Parse(registry.server.URL)
+	return u.Host
+}
+
+// AddBlob stores a blob under its digest and returns its descriptor.
+func (registry *Registry) AddBlob(mediaType string, content []byte) ocispec.Descriptor {
+	blobDigest := digest.FromBytes(content)
+
+	registry.ReplaceBlob(blobDigest, content)
+
+	return ocispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    blobDigest,
+		Size:      int64(len(content)),
+	}
+}
+
+// ReplaceBlob serves content under a digest regardless of whether it
+// matches, e.g. to serve a corrupted blob.
+func (registry *Registry) ReplaceBlob(blobDigest digest.Digest, content []byte) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	registry.blobs[blobDigest] = content
+}
+
+// AddManifest stores a manifest (or index) in a repository under its digest
+// and, unless it is empty, a tag, and returns its descriptor.
+func (registry *Registry) AddManifest(repository string, tag string, mediaType string, body []byte) ocispec.Descriptor {
+	manifestDigest := digest.FromBytes(body)
+
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	manifests, found := registry.manifests[repository]
+	if !found {
+		manifests = map[string]manifest{}
+		registry.manifests[repository] = manifests
+	}
+
+	manifests[string(manifestDigest)] = manifest{mediaType: mediaType, body: body}
+	if tag != "" {
+		manifests[tag] = manifest{mediaType: mediaType, body: body}
+	}
+
+	return ocispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    manifestDigest,
+		Size:      int64(len(body)),
+	}
+}
+
+// Image describes an image pushed to the registry.
+type Image struct {
+	Manifest ocispec.Descriptor
+	Config   ocispec.Descriptor
+	Layers   []ocispec.Descriptor
+}
+
+// PushImage stores an OCI image made of a config and layers in a repository,
+// tagging it unless the tag is empty. The config's diff IDs are filled in
+// from the layers unless they are given. The returned manifest descriptor
+// names the config's platform so that it can be pushed as part of an index.
+func (registry *Registry) PushImage(repository string, tag string, config ocispec.Image, layers ...Layer) Image {
+	if config.RootFS.Type == "" {
+		config.RootFS.Type = "layers"
+	}
+
+	if config.RootFS.DiffIDs == nil {
+		for _, layer := range layers {
+			config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, layer.DiffID)
+		}
+	}
+
+	image := Image{
+		Config: registry.AddBlob(ocispec.MediaTypeImageConfig, mustMarshal(config)),
+	}
+
+	for _, layer := range layers {
+		image.Layers = append(image.Layers, registry.AddBlob(layer.MediaType, layer.Blob))
+	}
+
+	manifest := ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    image.Config,
+		Layers:    image.Layers,
+	}
+	manifest.SchemaVersion = 2
+
+	image.Manifest = registry.AddManifest(repository, tag, manifest.MediaType, mustMarshal(manifest))
+	image.Manifest.Platform = &ocispec.Platform{
+		OS:           config.OS,
+		Architecture: config.Architecture,
+		Variant:      config.Variant,
+	}
+
+	return image
+}
+
+// PushIndex stores an OCI image index of manifests in a repository, tagging
+// it unless the tag is empty.
+func (registry *Registry) PushIndex(repository string, tag string, manifests ...ocispec.Descriptor) ocispec.Descriptor {
+	index := ocispec.Index{
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: manifests,
+	}
+	index.SchemaVersion = 2
+
+	return registry.AddManifest(repository, tag, index.MediaType, mustMarshal(index))
+}
+
+func (registry *Registry) serve(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	path, found := strings.CutPrefix(r.URL.Path, "/v2/")
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if path == "" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if repository, found := strings.CutSuffix(path, "/tags/list"); found {
+		registry.serveTags(w, repository)
+		return
+	}
+
+	if i := strings.LastIndex(path, "/manifests/"); i != -1 {
+		registry.serveManifest(w, r, path[:i], path[i+len("/manifests/"):])
+		return
+	}
+
+	if i := strings.LastIndex(path, "/blobs/"); i != -1 {
+		registry.serveBlob(w, r, digest.Digest(path[i+len("/blobs/"):]))
+		return
+	}
+
+	w.WriteHeader(http.StatusNotFound)
+}
+
+func (registry *Registry) serveManifest(w http.ResponseWriter, r *http.Request, repository string, ref string) {
+	registry.lock.Lock()
+	manifest, found := registry.manifests[repository][ref]
+	registry.lock.Unlock()
+
+	if !found {
+		writeError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", "manifest unknown")
+		return
+	}
+
+	w.Header().Set("Content-Type", manifest.mediaType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(manifest.body)))
+	w.Header().Set("Docker-Content-Digest", string(digest.FromBytes(manifest.body)))
+	w.WriteHeader(http.StatusOK)
+
+	if r.Method == http.MethodGet {
+		w.Write(manifest.body)
+	}
+}
+
+func (registry *Registry) serveBlob(w http.ResponseWriter, r *http.Request, blobDigest digest.Digest) {
+	registry.lock.Lock()
+	content, found := registry.blobs[blobDigest]
+	registry.lock.Unlock()
+
+	if !found {
+		writeError(w, http.StatusNotFound, "BLOB_UNKNOWN", "blob unknown to registry")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+	w.Header().Set("Docker-Content-Digest", string(blobDigest))
+	w.WriteHeader(http.StatusOK)
+
+	if r.Method == http.MethodGet {
+		w.Write(content)
+	}
+}
+
+func (registry *Registry) serveTags(w http.ResponseWriter, repository string) {
+	registry.lock.Lock()
+	manifests, found := registry.manifests[repository]
+
+	tags := []string{}
+	for ref := range manifests {
+		if _, err := digest.Parse(ref); err != nil {
+			tags = append(tags, ref)
+		}
+	}
+	registry.lock.Unlock()
+
+	if !found {
+		writeError(w, http.StatusNotFound, "NAME_UNKNOWN", "repository name not known to registry")
+		return
+	}
+
+	sort.Strings(tags)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"name": repository,
+		"tags": tags,
+	})
+}
+
+func writeError(w http.ResponseWriter, status int, code string, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `{"errors":[{"code":%q,"message":%q}]}`, code, message)
+}
+
+func mustMarshal(v any) []byte {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+
+	return b
+}
@@ -0,0 +1,35 @@
+package registry
+
+import (
+	"errors"
+	"strings"
+)
+
+const officialRegistry = "registry-1.docker.io"
+
+// ParseRepository splits a repository into the registry host and the
+// repository's name within that registry.
+func ParseRepository(repository string) (string, string, error) {
+	segs := strings.Split(repository, "/")
+
+	if len(segs) > 1 && (strings.Contains(segs[0], ":") || strings.Contains(segs[0], ".")) {
+		// In a private registry pretty much anything is valid.
+		return segs[0], strings.Join(segs[1:], "/"), nil
+	}
+	switch len(segs) {
+	case 3:
+		return segs[0], segs[1] + "/" + segs[2], nil
+	case 2:
+		return officialRegistry, segs[0] + "/" + segs[1], nil
+	case 1:
+		return officialRegistry, "library/" + segs[0], nil
+	}
+
+	return "", "", errors.New("malformed repository url")
+}
+
+// Does the repository include an explicitly declared registry host, such as 'foo.com/baz/bar'
+// that differs from the officialRegistry?
+func hasExplicitlyDeclaredRegistryHost(registryHost string) bool {
+	return strings.Contains(registryHost, ".") && registryHost != officialRegistry
+}
@@ -0,0 +1,29 @@
+package registry_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/concourse/docker-image-resource/registry"
+)
+
+var _ = Describe("ParseRepository", func() {
+	DescribeTable("splits the registry host from the repository name",
+		func(repository, expectedHost, expectedName string) {
+			host, name, err := registry.ParseRepository(repository)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(host).To(Equal(expectedHost))
+			Expect(name).To(Equal(expectedName))
+		},
+		Entry("official image", "alpine", "registry-1.docker.io", "library/alpine"),
+		Entry("docker hub image", "concourse/git-resource", "registry-1.docker.io", "concourse/git-resource"),
+		Entry("private registry", "registry.example.com/some/image", "registry.example.com", "some/image"),
+		Entry("private registry with port", "registry:5000/image", "registry:5000", "image"),
+		Entry("nested repository", "registry.example.com/a/b/c", "registry.example.com", "a/b/c"),
+	)
+
+	It("errors on a malformed repository", func() {
+		_, _, err := registry.ParseRepository("a/b/c/d")
+		Expect(err).To(MatchError("malformed repository url"))
+	})
+})
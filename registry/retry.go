@@ -0,0 +1,164 @@
+package registry
+
+import (
+	"io"
+	"net/http"
+	"time"
+
+	"code.cloudfoundry.org/lager/v3"
+	"github.com/concourse/retryhttp"
+)
+
+// Defaults for source.retry.
+const (
+	defaultRetryMaxElapsed      = 5 * time.Minute
+	defaultRetryInitialInterval = time.Second
+
+	// maxRetryInterval caps the exponential backoff between attempts.
+	maxRetryInterval = 16 * time.Second
+)
+
+// RetryPolicy configures how failed requests to a registry are retried:
+// with an exponential backoff from InitialInterval, for at most MaxAttempts
+// attempts (unlimited if zero) and as long as the next attempt would start
+// within MaxElapsed of the first.
+type RetryPolicy struct {
+	MaxAttempts     int       `json:"max_attempts"`
+	MaxElapsed      *Duration `json:"max_elapsed"`
+	InitialInterval *Duration `json:"initial_interval"`
+}
+
+func (policy *RetryPolicy) maxAttempts() int {
+	if policy == nil {
+		return 0
+	}
+
+	return policy.MaxAttempts
+}
+
+func (policy *RetryPolicy) maxElapsed() time.Duration {
+	if policy == nil || policy.MaxElapsed == nil {
+		return defaultRetryMaxElapsed
+	}
+
+	return time.Duration(*policy.MaxElapsed)
+}
+
+func (policy *RetryPolicy) initialInterval() time.Duration {
+	if policy == nil || policy.InitialInterval == nil {
+		return defaultRetryInitialInterval
+	}
+
+	return time.Duration(*policy.InitialInterval)
+}
+
+// interval returns how long to wait after the given number of failed
+// attempts.
+func (policy *RetryPolicy) interval(failedAttempts int) time.Duration {
+	interval := policy.initialInterval()
+	for i := 1; i < failedAttempts && interval < maxRetryInterval; i++ {
+		interval *= 2
+	}
+
+	return min(interval, max(maxRetryInterval, policy.initialInterval()))
+}
+
+// requestTimeout returns source.timeout, or the given default if it is not
+// configured.
+func (config Config) requestTimeout(defaultTimeout time.Duration) time.Duration {
+	if config.Timeout == nil {
+		return defaultTimeout
+	}
+
+	return time.Duration(*config.Timeout)
+}
+
+func maybeRetry(logger lager.Logger, config Config, rt http.RoundTripper, retry bool) http.RoundTripper {
+	if !retry {
+		return rt
+	}
+
+	return newRetryRoundTripper(logger, config, rt)
+}
+
+// retryRoundTripper retries idempotent requests according to source.retry
+// when they fail with an error which may be transient, such as a connection
+// reset, with a server error, or when rate limited without being told how
+// long to wait (which rateLimitRoundTripper handles otherwise).
+type retryRoundTripper struct {
+	logger  lager.Logger
+	policy  *RetryPolicy
+	retryer retryhttp.Retryer
+	rt      http.RoundTripper
+}
+
+func newRetryRoundTripper(logger lager.Logger, config Config, rt http.RoundTripper) *retryRoundTripper {
+	return &retryRoundTripper{
+		logger:  logger,
+		policy:  config.Retry,
+		retryer: &retryhttp.DefaultRetryer{},
+		rt:      rt,
+	}
+}
+
+func (rt *retryRoundTripper) RoundTrip(request *http.Request) (*http.Response, error) {
+	if !isIdempotent(request) {
+		return rt.rt.RoundTrip(request)
+	}
+
+	start := time.Now()
+	for failedAttempts := 1; ; failedAttempts++ {
+		response, err := rt.rt.RoundTrip(request)
+
+		reason, retryable := rt.retryable(response, err)
+		if !retryable {
+			return response, err
+		}
+
+		wait := rt.policy.interval(failedAttempts)
+		if maxAttempts := rt.policy.maxAttempts(); maxAttempts > 0 && failedAttempts >= maxAttempts {
+			return response, err
+		}
+		if time.Since(start)+wait > rt.policy.maxElapsed() {
+			return response, err
+		}
+
+		if response != nil {
+			io.Copy(io.Discard, response.Body)
+			response.Body.Close()
+		}
+
+		rt.logger.Info("retrying", lager.Data{
+			"url":             request.URL.String(),
+			"failed-attempts": failedAttempts,
+			"ran-for":         time.Since(start).String(),
+			"reason":          reason,
+		})
+
+		select {
+		case <-time.After(wait):
+		case <-request.Context().Done():
+			return nil, request.Context().Err()
+		}
+	}
+}
+
+// retryable reports whether a request may succeed if attempted again, and
+// why it failed.
+func (rt *retryRoundTripper) retryable(response *http.Response, err error) (string, bool) {
+	if err != nil {
+		return err.Error(), rt.retryer.IsRetryable(err)
+	}
+
+	switch {
+	case response.StatusCode >= http.StatusInternalServerError:
+		return response.Status, true
+	case response.StatusCode == http.StatusTooManyRequests:
+		// waits given by Retry-After are left to the rate limit round
+		// tripper, unless they have already passed
+		_, ok := retryAfter(response.Header.Get("Retry-After"), time.Now())
+		return response.Status, !ok
+	}
+
+	return "", false
+}
@@ -0,0 +1,187 @@
+package registry
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultDialTimeout is how long to wait to connect to a host when
+// source.timeout is not configured.
+const defaultDialTimeout = 30 * time.Second
+
+// hostTransport sends each request through a transport with the TLS
+// configuration of the request's host, so that ca_certs, client_certs and
+// insecure_registries only apply to the hosts they are configured for. This
+// matters as soon as requests leave the registry, e.g. for its token service
+// or for redirects to blob storage.
+type hostTransport struct {
+	config Config
+
+	transports map[string]*http.Transport
+	lock       sync.Mutex
+}
+
+func newHostTransport(config Config) (*hostTransport, error) {
+	for _, domainCert := range config.DomainCerts {
+		if !x509.NewCertPool().AppendCertsFromPEM([]byte(domainCert.Cert)) {
+			return nil, fmt.Errorf("failed to parse CA certificate for \"%s\"", domainCert.Domain)
+		}
+	}
+
+	for _, clientCert := range config.ClientCerts {
+		if _, err := tls.X509KeyPair([]byte(clientCert.Cert), []byte(clientCert.Key)); err != nil {
+			return nil, fmt.Errorf("failed to parse client certificate and/or key for \"%s\"", clientCert.Domain)
+		}
+	}
+
+	return &hostTransport{
+		config:     config,
+		transports: map[string]*http.Transport{},
+	}, nil
+}
+
+func (rt *hostTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	transport, err := rt.transport(canonicalHost(request.URL))
+	if err != nil {
+		return nil, err
+	}
+
+	return transport.RoundTrip(request)
+}
+
+func (rt *hostTransport) transport(host string) (*http.Transport, error) {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+
+	if transport, found := rt.transports[host]; found {
+		return transport, nil
+	}
+
+	tlsConfig, err := hostTLSConfig(rt.config, host)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		Dial: (&net.Dialer{
+			Timeout:   rt.config.requestTimeout(defaultDialTimeout),
+			KeepAlive: 30 * time.Second,
+			DualStack: true,
+		}).Dial,
+		DisableKeepAlives:     true,
+		TLSClientConfig:       tlsConfig,
+		ResponseHeaderTimeout: rt.config.requestTimeout(0),
+	}
+
+	rt.transports[host] = transport
+
+	return transport, nil
+}
+
+// hostTLSConfig returns the TLS configuration for a host: the system's CAs
+// plus the ca_certs for the host, its client_certs, and whether it is one of
+// the insecure_registries.
+func hostTLSConfig(config Config, host string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+
+	for _, hostOrCIDR := range config.InsecureRegistries {
+		if isInsecure(hostOrCIDR, host) {
+			tlsConfig.InsecureSkipVerify = true
+		}
+	}
+
+	for _, domainCert := range config.DomainCerts {
+		if !hostMatches(domainCert.Domain, host) {
+			continue
+		}
+
+		if tlsConfig.RootCAs == nil {
+			systemPool, err := x509.SystemCertPool()
+			if err != nil {
+				systemPool = x509.NewCertPool()
+			}
+			tlsConfig.RootCAs = systemPool
+		}
+
+		tlsConfig.RootCAs.AppendCertsFromPEM([]byte(domainCert.Cert))
+	}
+
+	clientCerts, err := setClientCert(host, config.ClientCerts)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(clientCerts) > 0 {
+		tlsConfig.GetClientCertificate = func(info *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return selectClientCert(clientCerts, info), nil
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// selectClientCert chooses the first of the host's client certificates which
+// the server accepts, falling back to the first one so that servers which do
+// not advertise the CAs they accept still receive a certificate.
+func selectClientCert(clientCerts []tls.Certificate, info *tls.CertificateRequestInfo) *tls.Certificate {
+	for i := range clientCerts {
+		if info.SupportsCertificate(&clientCerts[i]) == nil {
+			return &clientCerts[i]
+		}
+	}
+
+	return &clientCerts[0]
+}
+
+// canonicalHost returns the host of a URL including its port, which is
+// implied by the scheme when the URL does not specify it.
+func canonicalHost(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+
+	switch u.Scheme {
+	case "https":
+		return net.JoinHostPort(u.Hostname(), "443")
+	case "http":
+		return net.JoinHostPort(u.Hostname(), "80")
+	}
+
+	return u.Host
+}
+
+// hostMatches reports whether a configured domain applies to a host. A
+// domain without a port matches the host on any port, and a domain starting
+// with "*." matches any of its subdomains.
+func hostMatches(domain string, host string) bool {
+	domainName, domainPort := splitHostPort(domain)
+	hostname, port := splitHostPort(host)
+
+	if domainPort != "" && domainPort != port {
+		return false
+	}
+
+	if wildcard, ok := strings.CutPrefix(domainName, "*"); ok && strings.HasPrefix(wildcard, ".") {
+		return strings.HasSuffix(hostname, wildcard) && len(hostname) > len(wildcard)
+	}
+
+	return domainName == hostname
+}
+
+// splitHostPort splits a host into its hostname and port, if it has one.
+func splitHostPort(hostPort string) (string, string) {
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return hostPort, ""
+	}
+
+	return host, port
+}
@@ -0,0 +1,244 @@
+package registry_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"time"
+
+	"code.cloudfoundry.org/lager/v3/lagertest"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+
+	"github.com/concourse/docker-image-resource/registry"
+)
+
+var _ = Describe("TLS", func() {
+	var (
+		server *ghttp.Server
+		config registry.Config
+		caCert string
+	)
+
+	BeforeEach(func() {
+		server = ghttp.NewUnstartedServer()
+		server.HTTPTestServer.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+		server.HTTPTestServer.StartTLS()
+
+		server.RouteToHandler("GET", "/v2/", ghttp.RespondWith(http.StatusOK, "{}"))
+		server.RouteToHandler("HEAD", "/v2/some/image/manifests/latest", ghttp.RespondWith(http.StatusOK, "", http.Header{
+			"Docker-Content-Digest": {"sha256:c4c25c2cd70e3071f08cf124c4b5c656c061dd38247d166d97098d58eeea8aa6"},
+		}))
+
+		caCert = string(pem.EncodeToMemory(&pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: server.HTTPTestServer.Certificate().Raw,
+		}))
+
+		config = registry.Config{
+			Repository: server.Addr() + "/some/image",
+		}
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	resolve := func() error {
+		client, err := registry.NewClient(lagertest.NewTestLogger("registry"), config)
+		if err != nil {
+			return err
+		}
+
+		_, err = client.ResolveDigest("latest")
+		return err
+	}
+
+	It("trusts the CA configured for the registry's host", func() {
+		config.DomainCerts = []registry.DomainCert{
+			{Domain: server.Addr(), Cert: caCert},
+		}
+
+		Expect(resolve()).To(Succeed())
+	})
+
+	It("trusts the CA configured for the registry's hostname on any port", func() {
+		host, _, err := net.SplitHostPort(server.Addr())
+		Expect(err).ToNot(HaveOccurred())
+
+		config.DomainCerts = []registry.DomainCert{
+			{Domain: host, Cert: caCert},
+		}
+
+		Expect(resolve()).To(Succeed())
+	})
+
+	It("does not trust CAs configured for other hosts", func() {
+		config.DomainCerts = []registry.DomainCert{
+			{Domain: "registry.example.com", Cert: caCert},
+		}
+
+		Expect(resolve()).ToNot(Succeed())
+	})
+
+	It("fails on invalid CA certificates", func() {
+		config.DomainCerts = []registry.DomainCert{
+			{Domain: "registry.example.com", Cert: "bogus"},
+		}
+
+		Expect(resolve()).To(MatchError(ContainSubstring(`failed to parse CA certificate for "registry.example.com"`)))
+	})
+
+	It("presents the client certificate of an insecure registry", func() {
+		clientCert, clientKey := generateClientCert("some-client")
+
+		config.InsecureRegistries = []string{server.Addr()}
+		config.ClientCerts = []registry.ClientCertKey{
+			{Domain: server.Addr(), Cert: clientCert, Key: clientKey},
+		}
+
+		server.RouteToHandler("HEAD", "/v2/some/image/manifests/latest", ghttp.CombineHandlers(
+			func(w http.ResponseWriter, r *http.Request) {
+				Expect(r.TLS).ToNot(BeNil())
+				Expect(r.TLS.PeerCertificates).To(HaveLen(1))
+				Expect(r.TLS.PeerCertificates[0].Subject.CommonName).To(Equal("some-client"))
+			},
+			ghttp.RespondWith(http.StatusOK, "", http.Header{
+				"Docker-Content-Digest": {"sha256:c4c25c2cd70e3071f08cf124c4b5c656c061dd38247d166d97098d58eeea8aa6"},
+			}),
+		))
+
+		Expect(resolve()).To(Succeed())
+	})
+
+	Describe("client certificates", func() {
+		BeforeEach(func() {
+			config.DomainCerts = []registry.DomainCert{
+				{Domain: server.Addr(), Cert: caCert},
+			}
+		})
+
+		expectClientCert := func(commonName string) {
+			server.RouteToHandler("HEAD", "/v2/some/image/manifests/latest", ghttp.CombineHandlers(
+				func(w http.ResponseWriter, r *http.Request) {
+					Expect(r.TLS.PeerCertificates).To(HaveLen(1))
+					Expect(r.TLS.PeerCertificates[0].Subject.CommonName).To(Equal(commonName))
+				},
+				ghttp.RespondWith(http.StatusOK, "", http.Header{
+					"Docker-Content-Digest": {"sha256:c4c25c2cd70e3071f08cf124c4b5c656c061dd38247d166d97098d58eeea8aa6"},
+				}),
+			))
+		}
+
+		It("presents the certificate for the registry's hostname on any port", func() {
+			host, _, err := net.SplitHostPort(server.Addr())
+			Expect(err).ToNot(HaveOccurred())
+
+			clientCert, clientKey := generateClientCert("some-client")
+			config.ClientCerts = []registry.ClientCertKey{
+				{Domain: host, Cert: clientCert, Key: clientKey},
+			}
+
+			expectClientCert("some-client")
+			Expect(resolve()).To(Succeed())
+		})
+
+		It("does not present certificates for other hosts", func() {
+			clientCert, clientKey := generateClientCert("some-client")
+			config.ClientCerts = []registry.ClientCertKey{
+				{Domain: "registry.example.com", Cert: clientCert, Key: clientKey},
+			}
+
+			server.RouteToHandler("HEAD", "/v2/some/image/manifests/latest", ghttp.CombineHandlers(
+				func(w http.ResponseWriter, r *http.Request) {
+					Expect(r.TLS.PeerCertificates).To(BeEmpty())
+				},
+				ghttp.RespondWith(http.StatusOK, "", http.Header{
+					"Docker-Content-Digest": {"sha256:c4c25c2cd70e3071f08cf124c4b5c656c061dd38247d166d97098d58eeea8aa6"},
+				}),
+			))
+
+			Expect(resolve()).To(Succeed())
+		})
+
+		It("presents the certificate accepted by the server", func() {
+			otherCert, otherKey := generateClientCert("other-client")
+			acceptedCert, acceptedKey := generateClientCert("accepted-client")
+
+			block, _ := pem.Decode([]byte(acceptedCert))
+			parsed, err := x509.ParseCertificate(block.Bytes)
+			Expect(err).ToNot(HaveOccurred())
+
+			clientCAs := x509.NewCertPool()
+			clientCAs.AddCert(parsed)
+			server.HTTPTestServer.TLS.ClientCAs = clientCAs
+
+			config.ClientCerts = []registry.ClientCertKey{
+				{Domain: server.Addr(), Cert: otherCert, Key: otherKey},
+				{Domain: server.Addr(), Cert: acceptedCert, Key: acceptedKey},
+			}
+
+			expectClientCert("accepted-client")
+			Expect(resolve()).To(Succeed())
+		})
+	})
+})
+
+// generateClientCert returns a self-signed client certificate and its key,
+// PEM encoded.
+func generateClientCert(commonName string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).ToNot(HaveOccurred())
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).ToNot(HaveOccurred())
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	Expect(err).ToNot(HaveOccurred())
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+}
+
+var _ = DescribeTable("HostMatches",
+	func(domain string, host string, matches bool) {
+		Expect(registry.HostMatches(domain, host)).To(Equal(matches))
+	},
+	Entry("the same host and port", "registry.example.com:5000", "registry.example.com:5000", true),
+	Entry("a different port", "registry.example.com:5000", "registry.example.com:5001", false),
+	Entry("a hostname without a port", "registry.example.com", "registry.example.com:5000", true),
+	Entry("a different hostname", "registry.example.com", "other.example.com:5000", false),
+	Entry("a wildcard subdomain", "*.corp.local", "registry.corp.local:5000", true),
+	Entry("a nested wildcard subdomain", "*.corp.local", "eu.registry.corp.local", true),
+	Entry("the wildcard's own domain", "*.corp.local", "corp.local", false),
+	Entry("a wildcard with a port", "*.corp.local:5000", "registry.corp.local:5000", true),
+	Entry("a wildcard with a different port", "*.corp.local:5000", "registry.corp.local:5001", false),
+)
+
+var _ = DescribeTable("IsInsecure",
+	func(hostOrCIDR string, host string, insecure bool) {
+		Expect(registry.IsInsecure(hostOrCIDR, host)).To(Equal(insecure))
+	},
+	Entry("an IP address within a CIDR", "10.0.0.0/8", "10.1.2.3:5000", true),
+	Entry("an IP address outside a CIDR", "10.0.0.0/8", "192.168.1.1:5000", false),
+	Entry("a hostname resolving within a CIDR", "127.0.0.0/8", "localhost:5000", true),
+	Entry("a hostname resolving outside a CIDR", "10.0.0.0/8", "localhost:5000", false),
+	Entry("a hostname without a port", "localhost", "localhost:5000", true),
+	Entry("a wildcard", "*.corp.local", "registry.corp.local:5000", true),
+)
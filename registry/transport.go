@@ -0,0 +1,152 @@
+package registry
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"code.cloudfoundry.org/lager/v3"
+	"github.com/docker/distribution/registry/client/auth"
+	"github.com/docker/distribution/registry/client/auth/challenge"
+	"github.com/docker/distribution/registry/client/transport"
+	"github.com/hashicorp/go-multierror"
+)
+
+// tokenClientID identifies the resource to token servers when requesting
+// refresh tokens.
+const tokenClientID = "concourse-docker-image-resource"
+
+// defaultPingTimeout is how long to wait for a registry to respond to the
+// ping when source.timeout is not configured.
+const defaultPingTimeout = time.Minute
+
+// makeTransport pings the registry and sets up authentication against it.
+// Transport errors are retried only if retry is set, so that unavailable
+// mirrors can be skipped quickly.
+func makeTransport(logger lager.Logger, config Config, registryHost string, repository string, retry bool) (http.RoundTripper, string, error) {
+	hostTransport, err := newHostTransport(config)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var baseTransport http.RoundTripper = hostTransport
+	if config.Debug {
+		baseTransport = newDebugRoundTripper(logger, baseTransport)
+	}
+
+	authTransport := transport.NewTransport(baseTransport)
+
+	pingClient := &http.Client{
+		Transport: maybeRetry(logger, config, authTransport, retry),
+		Timeout:   config.requestTimeout(defaultPingTimeout),
+	}
+
+	challengeManager := challenge.NewSimpleManager()
+
+	var registryURL string
+
+	var pingResp *http.Response
+	var pingErr error
+	var pingErrs error
+	for _, scheme := range []string{"https", "http"} {
+		registryURL = scheme + "://" + registryHost
+
+		req, err := http.NewRequest("GET", registryURL+"/v2/", nil)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to create ping request: %w", err)
+		}
+
+		pingResp, pingErr = pingClient.Do(req)
+		if pingErr == nil {
+			// clear out previous attempts' failures
+			pingErrs = nil
+			break
+		}
+
+		pingErrs = multierror.Append(
+			pingErrs,
+			fmt.Errorf("ping %s: %w", scheme, pingErr),
+		)
+	}
+	if pingErrs != nil {
+		return nil, "", &PingError{Host: registryHost, Err: pingErrs}
+	}
+
+	defer pingResp.Body.Close()
+
+	err = challengeManager.AddResponse(pingResp)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to add response to challenge manager: %w", err)
+	}
+
+	credentialStore, err := newCredentialStore(config, registryHost, pingResp)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var tokenHandler auth.AuthenticationHandler
+	if token := credentialStore.registryToken(registryHost); token != "" {
+		tokenHandler = bearerHandler{token}
+	} else {
+		tokenHandler = auth.NewTokenHandlerWithOptions(auth.TokenHandlerOptions{
+			Transport:     authTransport,
+			Credentials:   credentialStore,
+			OfflineAccess: true,
+			ClientID:      tokenClientID,
+			Scopes: []auth.Scope{
+				auth.RepositoryScope{
+					Repository: repository,
+					Actions:    []string{"pull"},
+				},
+			},
+		})
+	}
+	basicHandler := auth.NewBasicHandler(credentialStore)
+	authorizer := auth.NewAuthorizer(challengeManager, tokenHandler, basicHandler)
+
+	return newRateLimitRoundTripper(logger, config, transport.NewTransport(baseTransport, authorizer)), registryURL, nil
+}
+
+// isInsecure reports whether an entry of insecure_registries applies to a
+// host. Like dockerd, a CIDR applies to hosts resolving to an IP address
+// within it; otherwise the entry is matched against the host as with
+// hostMatches.
+func isInsecure(hostOrCIDR string, hostPort string) bool {
+	_, cidr, err := net.ParseCIDR(hostOrCIDR)
+	if err != nil {
+		return hostMatches(hostOrCIDR, hostPort)
+	}
+
+	host, _ := splitHostPort(hostPort)
+
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		// an unresolvable host is simply not insecure; connecting to it will
+		// fail with a more meaningful error
+		ips, _ = net.LookupIP(host)
+	}
+
+	for _, ip := range ips {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func setClientCert(registry string, list []ClientCertKey) ([]tls.Certificate, error) {
+	var clientCert []tls.Certificate
+	for _, r := range list {
+		if hostMatches(r.Domain, registry) {
+			certKey, err := tls.X509KeyPair([]byte(r.Cert), []byte(r.Key))
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse client certificate and/or key for \"%s\"", r.Domain)
+			}
+			clientCert = append(clientCert, certKey)
+		}
+	}
+	return clientCert, nil
+}
@@ -0,0 +1,91 @@
+// Package rootfs flattens the layers of an image into its root filesystem,
+// either on disk or as a tar stream.
+package rootfs
+
+import (
+	"archive/tar"
+	"io"
+	"path"
+	"strings"
+)
+
+// Layer is a layer of an image whose uncompressed content is a tar archive.
+type Layer interface {
+	Open() (io.ReadCloser, error)
+}
+
+// Options control how layers are flattened.
+type Options struct {
+	// SkipDevices leaves out character and block devices, which cannot be
+	// created without privileges.
+	SkipDevices bool
+
+	// Chown sets the owner of each entry as the layers declare it, which
+	// requires privileges. Otherwise entries belong to the current user.
+	Chown bool
+}
+
+const (
+	whiteoutPrefix = ".wh."
+	opaqueWhiteout = ".wh..wh..opq"
+)
+
+// entryName returns the clean name of a tar entry relative to the root, e.g.
+// "etc/passwd" for "./etc/passwd", or "" for the root itself.
+func entryName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// whiteout returns what a whiteout entry removes and whether it is opaque,
+// i.e. removes everything its directory holds in lower layers.
+func whiteout(name string) (string, bool, bool) {
+	dir, base := path.Split(name)
+	dir = strings.TrimSuffix(dir, "/")
+
+	if base == opaqueWhiteout {
+		return dir, true, true
+	}
+
+	if removed, found := strings.CutPrefix(base, whiteoutPrefix); found {
+		return path.Join(dir, removed), false, true
+	}
+
+	return "", false, false
+}
+
+// skip reports whether an entry is left out altogether.
+func skip(header *tar.Header, options Options) bool {
+	switch header.Typeflag {
+	case tar.TypeChar, tar.TypeBlock:
+		return options.SkipDevices
+	case tar.TypeXGlobalHeader:
+		return true
+	}
+
+	return false
+}
+
+// forEachEntry calls fn with each entry of a layer, whose content may be read
+// from the tar reader.
+func forEachEntry(layer Layer, fn func(*tar.Header, *tar.Reader) error) error {
+	content, err := layer.Open()
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	tr := tar.NewReader(content)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := fn(header, tr); err != nil {
+			return err
+		}
+	}
+}
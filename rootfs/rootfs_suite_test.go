@@ -0,0 +1,13 @@
+package rootfs_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestRootfs(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Rootfs Suite")
+}
@@ -0,0 +1,369 @@
+package rootfs_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	digest "github.com/opencontainers/go-digest"
+
+	"github.com/concourse/docker-image-resource/image"
+	"github.com/concourse/docker-image-resource/registry/registrytest"
+	"github.com/concourse/docker-image-resource/rootfs"
+)
+
+var _ = Describe("Rootfs", func() {
+	var (
+		blobsDir string
+		layers   []rootfs.Layer
+		options  rootfs.Options
+	)
+
+	BeforeEach(func() {
+		blobsDir = GinkgoT().TempDir()
+		layers = nil
+		options = rootfs.Options{}
+	})
+
+	addLayer := func(layer registrytest.Layer) {
+		path := filepath.Join(blobsDir, digest.FromBytes(layer.Blob).Encoded())
+		Expect(os.WriteFile(path, layer.Blob, 0644)).To(Succeed())
+
+		layers = append(layers, image.Layer{Path: path})
+	}
+
+	entry := func(typeflag byte, name string, linkname string) registrytest.File {
+		return registrytest.File{Header: tar.Header{Typeflag: typeflag, Name: name, Linkname: linkname}}
+	}
+
+	Describe("Unpack", func() {
+		var dir string
+
+		BeforeEach(func() {
+			dir = filepath.Join(GinkgoT().TempDir(), "rootfs")
+		})
+
+		unpack := func() error {
+			return rootfs.Unpack(dir, layers, options)
+		}
+
+		readFile := func(name string) string {
+			content, err := os.ReadFile(filepath.Join(dir, name))
+			Expect(err).ToNot(HaveOccurred())
+			return string(content)
+		}
+
+		It("applies gzip, zstd and uncompressed layers in order", func() {
+			addLayer(registrytest.GzipLayer(
+				registrytest.Dir("etc/"),
+				registrytest.RegularFile("etc/hostname", "lower"),
+				registrytest.RegularFile("etc/motd", "hello"),
+			))
+			addLayer(registrytest.ZstdLayer(registrytest.RegularFile("etc/hostname", "upper")))
+			addLayer(registrytest.UncompressedLayer(registrytest.RegularFile("bin/tool", "#!/bin/sh")))
+
+			Expect(unpack()).To(Succeed())
+
+			Expect(readFile("etc/hostname")).To(Equal("upper"))
+			Expect(readFile("etc/motd")).To(Equal("hello"))
+			Expect(readFile("bin/tool")).To(Equal("#!/bin/sh"))
+		})
+
+		It("sets modes, including setuid and sticky bits", func() {
+			setuid := registrytest.RegularFile("bin/su", "")
+			setuid.Mode = 04755
+			sticky := registrytest.Dir("tmp/")
+			sticky.Mode = 01777
+			addLayer(registrytest.GzipLayer(setuid, sticky))
+
+			Expect(unpack()).To(Succeed())
+
+			info, err := os.Stat(filepath.Join(dir, "bin/su"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(info.Mode()).To(Equal(os.FileMode(0755) | os.ModeSetuid))
+
+			info, err = os.Stat(filepath.Join(dir, "tmp"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(info.Mode()).To(Equal(os.FileMode(0777) | os.ModeDir | os.ModeSticky))
+		})
+
+		It("creates symlinks and hardlinks", func() {
+			addLayer(registrytest.GzipLayer(
+				registrytest.RegularFile("bin/busybox", "busybox"),
+				entry(tar.TypeLink, "bin/sh", "bin/busybox"),
+				entry(tar.TypeSymlink, "bin/ash", "busybox"),
+			))
+
+			Expect(unpack()).To(Succeed())
+
+			link, err := os.Readlink(filepath.Join(dir, "bin/ash"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(link).To(Equal("busybox"))
+
+			busybox, err := os.Stat(filepath.Join(dir, "bin/busybox"))
+			Expect(err).ToNot(HaveOccurred())
+			sh, err := os.Stat(filepath.Join(dir, "bin/sh"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(os.SameFile(busybox, sh)).To(BeTrue())
+		})
+
+		It("replaces directories with files and files with directories", func() {
+			addLayer(registrytest.GzipLayer(
+				registrytest.Dir("a/"),
+				registrytest.RegularFile("a/file", "lower"),
+				registrytest.RegularFile("b", "lower"),
+			))
+			addLayer(registrytest.GzipLayer(
+				registrytest.RegularFile("a", "upper"),
+				registrytest.Dir("b/"),
+			))
+
+			Expect(unpack()).To(Succeed())
+
+			Expect(readFile("a")).To(Equal("upper"))
+			Expect(filepath.Join(dir, "b")).To(BeADirectory())
+		})
+
+		It("removes what whiteouts refer to", func() {
+			addLayer(registrytest.GzipLayer(
+				registrytest.RegularFile("etc/removed", ""),
+				registrytest.RegularFile("etc/kept", ""),
+				registrytest.RegularFile("var/cache/removed", ""),
+			))
+			addLayer(registrytest.GzipLayer(
+				registrytest.RegularFile("etc/.wh.removed", ""),
+				registrytest.RegularFile("var/.wh.cache", ""),
+			))
+
+			Expect(unpack()).To(Succeed())
+
+			Expect(filepath.Join(dir, "etc/removed")).ToNot(BeAnExistingFile())
+			Expect(filepath.Join(dir, "etc/.wh.removed")).ToNot(BeAnExistingFile())
+			Expect(filepath.Join(dir, "etc/kept")).To(BeARegularFile())
+			Expect(filepath.Join(dir, "var/cache")).ToNot(BeAnExistingFile())
+		})
+
+		It("clears opaque directories of what lower layers put in them", func() {
+			addLayer(registrytest.GzipLayer(
+				registrytest.RegularFile("opt/lower", ""),
+				registrytest.RegularFile("opt/replaced", "lower"),
+			))
+			addLayer(registrytest.GzipLayer(
+				registrytest.Dir("opt/"),
+				registrytest.RegularFile("opt/replaced", "upper"),
+				registrytest.RegularFile("opt/.wh..wh..opq", ""),
+				registrytest.RegularFile("opt/upper", ""),
+			))
+
+			Expect(unpack()).To(Succeed())
+
+			Expect(filepath.Join(dir, "opt/lower")).ToNot(BeAnExistingFile())
+			Expect(filepath.Join(dir, "opt/.wh..wh..opq")).ToNot(BeAnExistingFile())
+			Expect(readFile("opt/replaced")).To(Equal("upper"))
+			Expect(filepath.Join(dir, "opt/upper")).To(BeARegularFile())
+		})
+
+		It("keeps symlinks and names from escaping the root", func() {
+			outside := GinkgoT().TempDir()
+
+			addLayer(registrytest.GzipLayer(
+				entry(tar.TypeSymlink, "relative", "../../../../../.."+outside),
+				entry(tar.TypeSymlink, "absolute", outside),
+				registrytest.RegularFile("../../escaped-by-name", ""),
+			))
+			addLayer(registrytest.GzipLayer(
+				registrytest.RegularFile("relative/relative-file", ""),
+				registrytest.RegularFile("absolute/absolute-file", ""),
+			))
+
+			Expect(unpack()).To(Succeed())
+
+			Expect(os.ReadDir(outside)).To(BeEmpty())
+			Expect(filepath.Join(dir, outside, "relative-file")).To(BeARegularFile())
+			Expect(filepath.Join(dir, outside, "absolute-file")).To(BeARegularFile())
+			Expect(filepath.Join(dir, "escaped-by-name")).To(BeARegularFile())
+		})
+
+		It("keeps hardlinks from linking to files outside the root", func() {
+			outside := GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0600)).To(Succeed())
+
+			addLayer(registrytest.GzipLayer(
+				entry(tar.TypeSymlink, "absolute", outside),
+				entry(tar.TypeLink, "hardlink", "absolute/secret"),
+			))
+
+			Expect(unpack()).To(MatchError(ContainSubstring("hardlink")))
+
+			info, err := os.Stat(filepath.Join(outside, "secret"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(info.Sys().(*syscall.Stat_t).Nlink).To(BeEquivalentTo(1))
+		})
+
+		It("leaves out devices when told to", func() {
+			options.SkipDevices = true
+
+			device := entry(tar.TypeChar, "dev/null", "")
+			device.Devmajor = 1
+			device.Devminor = 3
+			addLayer(registrytest.GzipLayer(device, entry(tar.TypeFifo, "run/fifo", "")))
+
+			Expect(unpack()).To(Succeed())
+
+			Expect(filepath.Join(dir, "dev/null")).ToNot(BeAnExistingFile())
+
+			info, err := os.Lstat(filepath.Join(dir, "run/fifo"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(info.Mode() & os.ModeNamedPipe).ToNot(BeZero())
+		})
+
+		Context("when privileged", func() {
+			BeforeEach(func() {
+				if os.Geteuid() != 0 {
+					Skip("requires root")
+				}
+
+				options.Chown = true
+			})
+
+			It("creates devices and sets ownership", func() {
+				device := entry(tar.TypeChar, "dev/null", "")
+				device.Devmajor = 1
+				device.Devminor = 3
+				device.Mode = 0666
+
+				owned := registrytest.RegularFile("home/user/file", "")
+				owned.Uid = 1000
+				owned.Gid = 1001
+				owned.Mode = 02755
+
+				addLayer(registrytest.GzipLayer(device, owned))
+
+				Expect(unpack()).To(Succeed())
+
+				info, err := os.Lstat(filepath.Join(dir, "dev/null"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(info.Mode() & os.ModeCharDevice).ToNot(BeZero())
+
+				info, err = os.Lstat(filepath.Join(dir, "home/user/file"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(info.Sys().(*syscall.Stat_t).Uid).To(BeEquivalentTo(1000))
+				Expect(info.Sys().(*syscall.Stat_t).Gid).To(BeEquivalentTo(1001))
+				Expect(info.Mode()).To(Equal(os.FileMode(0755) | os.ModeSetgid))
+			})
+		})
+	})
+
+	Describe("WriteTar", func() {
+		type tarEntry struct {
+			header *tar.Header
+			body   string
+		}
+
+		writeTar := func() ([]string, map[string]tarEntry) {
+			buf := new(bytes.Buffer)
+			Expect(rootfs.WriteTar(buf, layers, options)).To(Succeed())
+
+			var names []string
+			entries := map[string]tarEntry{}
+
+			tr := tar.NewReader(buf)
+			for {
+				header, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				Expect(err).ToNot(HaveOccurred())
+
+				body, err := io.ReadAll(tr)
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(entries).ToNot(HaveKey(header.Name), "written twice")
+				names = append(names, header.Name)
+				entries[header.Name] = tarEntry{header: header, body: string(body)}
+			}
+
+			return names, entries
+		}
+
+		It("writes the entries the upper layers do not replace or remove, in order", func() {
+			addLayer(registrytest.GzipLayer(
+				registrytest.Dir("etc/"),
+				registrytest.RegularFile("etc/hostname", "lower"),
+				registrytest.RegularFile("etc/removed", ""),
+				registrytest.RegularFile("opt/lower", ""),
+				registrytest.Dir("var/"),
+				registrytest.RegularFile("var/file", ""),
+			))
+			addLayer(registrytest.ZstdLayer(
+				registrytest.RegularFile("etc/hostname", "upper"),
+				registrytest.RegularFile("etc/.wh.removed", ""),
+				registrytest.RegularFile("opt/.wh..wh..opq", ""),
+				registrytest.RegularFile("opt/upper", ""),
+				registrytest.RegularFile("var", "not a directory"),
+			))
+
+			names, entries := writeTar()
+
+			Expect(names).To(Equal([]string{"etc/", "etc/hostname", "opt/upper", "var"}))
+			Expect(entries["etc/hostname"].body).To(Equal("upper"))
+			Expect(entries["var"].body).To(Equal("not a directory"))
+		})
+
+		It("writes a hidden file in place of the first hardlink to it", func() {
+			addLayer(registrytest.GzipLayer(
+				registrytest.RegularFile("bin/busybox", "busybox"),
+				entry(tar.TypeLink, "bin/sh", "bin/busybox"),
+				entry(tar.TypeLink, "bin/ash", "bin/busybox"),
+				entry(tar.TypeLink, "bin/kept", "./bin/sh"),
+			))
+			addLayer(registrytest.GzipLayer(
+				registrytest.RegularFile("bin/.wh.busybox", ""),
+			))
+
+			names, entries := writeTar()
+
+			Expect(names).To(Equal([]string{"bin/sh", "bin/ash", "bin/kept"}))
+			Expect(entries["bin/sh"].header.Typeflag).To(BeEquivalentTo(tar.TypeReg))
+			Expect(entries["bin/sh"].body).To(Equal("busybox"))
+			Expect(entries["bin/ash"].header.Linkname).To(Equal("bin/sh"))
+			Expect(entries["bin/kept"].header.Linkname).To(Equal("bin/sh"))
+		})
+
+		It("leaves out devices when told to", func() {
+			options.SkipDevices = true
+			addLayer(registrytest.GzipLayer(entry(tar.TypeChar, "dev/null", ""), registrytest.Dir("dev/")))
+
+			names, _ := writeTar()
+			Expect(names).To(Equal([]string{"dev/"}))
+		})
+
+		It("unpacks into the same filesystem as the layers", func() {
+			addLayer(registrytest.GzipLayer(
+				registrytest.RegularFile("etc/hostname", "lower"),
+				registrytest.RegularFile("etc/removed", ""),
+			))
+			addLayer(registrytest.GzipLayer(
+				registrytest.RegularFile("etc/hostname", "upper"),
+				registrytest.RegularFile("etc/.wh.removed", ""),
+			))
+
+			buf := new(bytes.Buffer)
+			Expect(rootfs.WriteTar(buf, layers, options)).To(Succeed())
+
+			flattened := filepath.Join(blobsDir, "flattened")
+			Expect(os.WriteFile(flattened, buf.Bytes(), 0644)).To(Succeed())
+
+			dir := GinkgoT().TempDir()
+			Expect(rootfs.Unpack(dir, []rootfs.Layer{image.Layer{Path: flattened}}, options)).To(Succeed())
+
+			Expect(filepath.Join(dir, "etc/removed")).ToNot(BeAnExistingFile())
+			Expect(os.ReadFile(filepath.Join(dir, "etc/hostname"))).To(BeEquivalentTo("upper"))
+		})
+	})
+})
@@ -0,0 +1,232 @@
+package rootfs
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"path"
+)
+
+// WriteTar streams the filesystem the layers flatten into as a single tar
+// archive, without unpacking it. The layers are read twice: from the top
+// down to find which entries are not replaced or removed by upper layers, and
+// from the bottom up to write those entries in the order they were created.
+func WriteTar(w io.Writer, layers []Layer, options Options) error {
+	plans := make([]*layerPlan, len(layers))
+
+	upper := newFilesystem()
+	for i := len(layers) - 1; i >= 0; i-- {
+		plan, err := planLayer(layers[i], upper, options)
+		if err != nil {
+			return fmt.Errorf("failed to read layer %d: %w", i+1, err)
+		}
+
+		plans[i] = plan
+	}
+
+	tw := tar.NewWriter(w)
+
+	for i, layer := range layers {
+		if err := writeLayer(tw, layer, plans[i]); err != nil {
+			return fmt.Errorf("failed to write layer %d: %w", i+1, err)
+		}
+	}
+
+	return tw.Close()
+}
+
+// filesystem tracks what the layers above the one being planned hide.
+type filesystem struct {
+	// entries are the paths of upper layers, and whether they are
+	// directories, which lower layers may add to
+	entries map[string]bool
+	// removed are the paths removed by whiteouts of upper layers
+	removed map[string]bool
+	// opaque are the directories whose lower contents are removed
+	opaque map[string]bool
+}
+
+func newFilesystem() *filesystem {
+	return &filesystem{
+		entries: map[string]bool{},
+		removed: map[string]bool{},
+		opaque:  map[string]bool{},
+	}
+}
+
+// hides reports whether an entry of a lower layer is hidden by upper layers.
+func (fs *filesystem) hides(name string) bool {
+	if _, found := fs.entries[name]; found {
+		return true
+	}
+
+	if fs.removed[name] {
+		return true
+	}
+
+	for dir := name; dir != ""; {
+		dir = parent(dir)
+
+		if isDir, found := fs.entries[dir]; found && !isDir {
+			return true
+		}
+
+		if fs.removed[dir] || fs.opaque[dir] {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (fs *filesystem) merge(layer *filesystem) {
+	for name, isDir := range layer.entries {
+		fs.entries[name] = isDir
+	}
+
+	for name := range layer.removed {
+		fs.removed[name] = true
+	}
+
+	for name := range layer.opaque {
+		fs.opaque[name] = true
+	}
+}
+
+// layerPlan is what to write of a layer.
+type layerPlan struct {
+	// visible are the entries to write as they are
+	visible map[string]bool
+	// links are the hardlinks to write, by the name of what they link to
+	links map[string]string
+	// copies are the hidden files which visible hardlinks link to, by the
+	// name they are to be written as in their stead
+	copies map[string]string
+}
+
+// planLayer finds the entries of a layer which the upper layers do not hide,
+// then adds what the layer hides to the upper layers'.
+func planLayer(layer Layer, upper *filesystem, options Options) (*layerPlan, error) {
+	plan := &layerPlan{
+		visible: map[string]bool{},
+		links:   map[string]string{},
+		copies:  map[string]string{},
+	}
+
+	own := newFilesystem()
+
+	// copied are the names hidden files are written as
+	copied := map[string]bool{}
+
+	err := forEachEntry(layer, func(header *tar.Header, _ *tar.Reader) error {
+		name := entryName(header.Name)
+
+		if removed, opaque, found := whiteout(name); found {
+			if opaque {
+				own.opaque[removed] = true
+			} else {
+				own.removed[removed] = true
+			}
+			return nil
+		}
+
+		if skip(header, options) {
+			return nil
+		}
+
+		own.entries[name] = header.Typeflag == tar.TypeDir
+
+		if upper.hides(name) {
+			return nil
+		}
+
+		plan.visible[name] = true
+
+		if header.Typeflag != tar.TypeLink {
+			return nil
+		}
+
+		target := entryName(header.Linkname)
+		if _, found := own.entries[target]; !found || plan.visible[target] || copied[target] {
+			return nil
+		}
+
+		// the file linked to is hidden, so the first link to it takes its
+		// content and further links link to that one instead
+		if first, found := plan.copies[target]; found {
+			plan.links[name] = first
+		} else {
+			plan.copies[target] = name
+			copied[name] = true
+			delete(plan.visible, name)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	upper.merge(own)
+
+	return plan, nil
+}
+
+func writeLayer(tw *tar.Writer, layer Layer, plan *layerPlan) error {
+	return forEachEntry(layer, func(header *tar.Header, tr *tar.Reader) error {
+		name := entryName(header.Name)
+
+		if copyName, found := plan.copies[name]; found && isRegular(header) {
+			header.Name = copyName
+			return writeEntry(tw, header, tr)
+		}
+
+		if !plan.visible[name] {
+			return nil
+		}
+
+		header.Name = name
+
+		if header.Typeflag == tar.TypeLink {
+			header.Linkname = entryName(header.Linkname)
+			if first, found := plan.links[name]; found {
+				header.Linkname = first
+			}
+		}
+
+		return writeEntry(tw, header, tr)
+	})
+}
+
+func writeEntry(tw *tar.Writer, header *tar.Header, content io.Reader) error {
+	if header.Name == "" {
+		header.Name = "./"
+	} else if header.Typeflag == tar.TypeDir {
+		header.Name += "/"
+	}
+
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+
+	if isRegular(header) {
+		_, err := io.Copy(tw, content)
+		return err
+	}
+
+	return nil
+}
+
+func isRegular(header *tar.Header) bool {
+	return header.Typeflag == tar.TypeReg || header.Typeflag == tar.TypeRegA
+}
+
+// parent returns the directory containing an entry, "" being the root.
+func parent(name string) string {
+	dir := path.Dir(name)
+	if dir == "." || dir == "/" {
+		return ""
+	}
+
+	return dir
+}
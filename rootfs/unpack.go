@@ -0,0 +1,309 @@
+package rootfs
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Unpack applies layers in order into a directory as if it were the root:
+// entries of upper layers replace those of lower layers, and whiteouts remove
+// them. Symlinks are followed within the directory only, so that no entry is
+// ever written outside of it.
+func Unpack(dir string, layers []Layer, options Options) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	unpacker := &unpacker{
+		root:     dir,
+		options:  options,
+		dirTimes: map[string]time.Time{},
+	}
+
+	for i, layer := range layers {
+		if err := unpacker.apply(layer); err != nil {
+			return fmt.Errorf("failed to apply layer %d: %w", i+1, err)
+		}
+	}
+
+	// directories are modified by their children, so their times are set last
+	for dir, modTime := range unpacker.dirTimes {
+		os.Chtimes(dir, modTime, modTime)
+	}
+
+	return nil
+}
+
+type unpacker struct {
+	root    string
+	options Options
+
+	// created are the paths created by the layer being applied, which its
+	// own whiteouts do not remove
+	created  map[string]bool
+	dirTimes map[string]time.Time
+}
+
+func (unpacker *unpacker) apply(layer Layer) error {
+	unpacker.created = map[string]bool{}
+
+	return forEachEntry(layer, func(header *tar.Header, tr *tar.Reader) error {
+		name := entryName(header.Name)
+
+		if removed, opaque, found := whiteout(name); found {
+			if opaque {
+				return unpacker.clear(removed)
+			}
+
+			return unpacker.remove(removed)
+		}
+
+		if skip(header, unpacker.options) {
+			return nil
+		}
+
+		if err := unpacker.create(name, header, tr); err != nil {
+			return fmt.Errorf("%s: %w", header.Name, err)
+		}
+
+		return nil
+	})
+}
+
+// remove removes what a whiteout refers to, unless the layer created it.
+func (unpacker *unpacker) remove(name string) error {
+	target, err := resolve(unpacker.root, name)
+	if err != nil {
+		return err
+	}
+
+	if target == unpacker.root || unpacker.created[target] {
+		return nil
+	}
+
+	return os.RemoveAll(target)
+}
+
+// clear removes what a directory holds from lower layers.
+func (unpacker *unpacker) clear(name string) error {
+	dir, err := resolveDir(unpacker.root, name)
+	if err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		child := filepath.Join(dir, entry.Name())
+		if unpacker.created[child] {
+			continue
+		}
+
+		if err := os.RemoveAll(child); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (unpacker *unpacker) create(name string, header *tar.Header, content io.Reader) error {
+	target, err := resolve(unpacker.root, name)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+
+	existing, err := os.Lstat(target)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	// directories are merged with those of lower layers; anything else is
+	// replaced
+	if existing != nil && !(existing.IsDir() && header.Typeflag == tar.TypeDir) {
+		if target == unpacker.root {
+			return errors.New("cannot replace the root")
+		}
+
+		if err := os.RemoveAll(target); err != nil {
+			return err
+		}
+	}
+
+	mode := header.FileInfo().Mode()
+
+	switch header.Typeflag {
+	case tar.TypeDir:
+		if existing == nil || !existing.IsDir() {
+			if err := os.Mkdir(target, 0755); err != nil {
+				return err
+			}
+		}
+
+		unpacker.dirTimes[target] = header.ModTime
+
+	case tar.TypeReg, tar.TypeRegA:
+		file, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY|unix.O_NOFOLLOW, 0600)
+		if err != nil {
+			return err
+		}
+
+		_, err = io.Copy(file, content)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+
+	case tar.TypeSymlink:
+		if err := os.Symlink(header.Linkname, target); err != nil {
+			return err
+		}
+
+	case tar.TypeLink:
+		linked, err := resolve(unpacker.root, entryName(header.Linkname))
+		if err != nil {
+			return err
+		}
+
+		if err := os.Link(linked, target); err != nil {
+			return err
+		}
+
+		// the link shares the owner, mode and times of what it links to
+		unpacker.created[target] = true
+		return nil
+
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		deviceMode := uint32(unix.S_IFIFO)
+		switch header.Typeflag {
+		case tar.TypeChar:
+			deviceMode = unix.S_IFCHR
+		case tar.TypeBlock:
+			deviceMode = unix.S_IFBLK
+		}
+
+		err := unix.Mknod(target, deviceMode|uint32(mode.Perm()), int(unix.Mkdev(uint32(header.Devmajor), uint32(header.Devminor))))
+		if err != nil {
+			return err
+		}
+
+	default:
+		return fmt.Errorf("unsupported entry type '%c'", header.Typeflag)
+	}
+
+	unpacker.created[target] = true
+
+	if unpacker.options.Chown {
+		if err := os.Lchown(target, header.Uid, header.Gid); err != nil {
+			return err
+		}
+	}
+
+	if header.Typeflag == tar.TypeSymlink {
+		return nil
+	}
+
+	// after chown, which clears the setuid and setgid bits
+	if err := os.Chmod(target, mode.Perm()|mode&(os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+		return err
+	}
+
+	if header.Typeflag != tar.TypeDir {
+		return os.Chtimes(target, header.AccessTime, header.ModTime)
+	}
+
+	return nil
+}
+
+// maxSymlinks is how many symlinks may be followed to resolve a path, as on
+// Linux.
+const maxSymlinks = 40
+
+// resolve returns where an entry lives in the root, following the symlinks
+// among its parent directories within the root. The entry itself is not
+// followed, as it is what is created or removed.
+func resolve(root string, name string) (string, error) {
+	if name == "" {
+		return root, nil
+	}
+
+	parent, err := resolveDir(root, path.Dir(name))
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(parent, path.Base(name)), nil
+}
+
+// resolveDir returns where a directory lives in the root, following symlinks
+// as if the root were /, i.e. absolute symlinks are relative to the root and
+// ".." never leaves it.
+func resolveDir(root string, name string) (string, error) {
+	var resolved string
+	remaining := strings.Split(name, "/")
+
+	var followed int
+	for len(remaining) > 0 {
+		component := remaining[0]
+		remaining = remaining[1:]
+
+		switch component {
+		case "", ".":
+			continue
+		case "..":
+			resolved = strings.TrimPrefix(path.Dir("/"+resolved), "/")
+			continue
+		}
+
+		next := path.Join(resolved, component)
+
+		info, err := os.Lstat(filepath.Join(root, next))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+
+		if info == nil || info.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		followed++
+		if followed > maxSymlinks {
+			return "", fmt.Errorf("%s: too many levels of symbolic links", name)
+		}
+
+		link, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+
+		if path.IsAbs(link) {
+			resolved = ""
+		}
+
+		remaining = append(strings.Split(link, "/"), remaining...)
+	}
+
+	return filepath.Join(root, resolved), nil
+}
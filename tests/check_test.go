@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 	"os/exec"
+	"regexp"
 
 	"encoding/json"
 	"os"
@@ -169,4 +170,46 @@ var _ = Describe("Check", func() {
 			})
 		})
 	})
+
+	Context("when a tag regex is configured", func() {
+		var (
+			registry *ghttp.Server
+			session  *gexec.Session
+
+			newestFakeDigest string = "sha256:c4c25c2cd70e3071f08cf124c4b5c656c061dd38247d166d97098d58eeea8aa6"
+		)
+
+		BeforeEach(func() {
+			registry = ghttp.NewServer()
+			registry.AllowUnhandledRequests = true
+
+			registry.RouteToHandler("GET", "/v2/", ghttp.RespondWith(http.StatusOK, "fake registry"))
+			registry.RouteToHandler("GET", "/v2/some/fake-image/tags/list", func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Query().Get("last") == "" {
+					w.Header().Set("Link", `</v2/some/fake-image/tags/list?last=1.9.0&n=3>; rel="next"`)
+					w.Write([]byte(`{"name":"some/fake-image","tags":["1.2.0","latest","1.9.0"]}`))
+					return
+				}
+				w.Write([]byte(`{"name":"some/fake-image","tags":["1.10.0","2.0.0"]}`))
+			})
+			registry.RouteToHandler("HEAD", "/v2/some/fake-image/manifests/1.10.0", ghttp.RespondWith(http.StatusOK, "", http.Header{
+				"Docker-Content-Digest": {newestFakeDigest},
+			}))
+
+			session = check(map[string]any{
+				"source": map[string]any{
+					"repository": registry.Addr() + "/some/fake-image",
+					"tag_regex":  `1\.\d+\.\d+`,
+				},
+			})
+		})
+
+		AfterEach(func() {
+			registry.Close()
+		})
+
+		It("prints out the newest matching tag and its digest", func() {
+			Expect(session.Out).To(gbytes.Say(regexp.QuoteMeta(fmt.Sprintf(`[{"digest":"%s","tag":"1.10.0"}]`, newestFakeDigest))))
+		})
+	})
 })